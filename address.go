@@ -0,0 +1,339 @@
+package go_consul_dns
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxCNAMEDepth is max count of CNAME hops from SRV target to address records
+const maxCNAMEDepth = 8
+
+// AddressFamily defines which addresses of SRV targets are resolved
+type AddressFamily int
+
+const (
+	// AddressFamilyIPv4 resolves only IPv4 addresses with A records
+	AddressFamilyIPv4 AddressFamily = iota
+	// AddressFamilyIPv6 resolves only IPv6 addresses with AAAA records
+	AddressFamilyIPv6
+	// AddressFamilyBoth resolves IPv4 and IPv6 addresses, the target with both addresses gives two endpoints
+	AddressFamilyBoth
+	// AddressFamilyPreferIPv6 resolves IPv6 address and falls back to IPv4 address, if the target has no IPv6 address
+	AddressFamilyPreferIPv6
+)
+
+// parseAddrTarget returns IP address encoded in the SRV target like '7f000001.addr.dc1.consul.'
+// or 'fd000000000000000000000000000001.addr.dc1.consul.'
+func parseAddrTarget(target string) (net.IP, bool) {
+	labels := strings.SplitN(target, ".", 3)
+	if len(labels) < 3 || labels[1] != "addr" {
+		return nil, false
+	}
+
+	b, err := hex.DecodeString(labels[0])
+	if err != nil {
+		return nil, false
+	}
+
+	switch len(b) {
+	case net.IPv4len:
+		return net.IPv4(b[0], b[1], b[2], b[3]), true
+	case net.IPv6len:
+		return net.IP(b), true
+	}
+
+	return nil, false
+}
+
+// hostAddresses contains the first IPv4 and IPv6 addresses of the SRV target
+type hostAddresses struct {
+	v4 net.IP
+	v6 net.IP
+}
+
+// add stores address from A or AAAA record, returns false for other records
+func (h *hostAddresses) add(body dnsmessage.ResourceBody) bool {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		if h.v4 == nil {
+			h.v4 = net.IPv4(b.A[0], b.A[1], b.A[2], b.A[3])
+		}
+		return true
+	case *dnsmessage.AAAAResource:
+		if h.v6 == nil {
+			h.v6 = make(net.IP, net.IPv6len)
+			copy(h.v6, b.AAAA[:])
+		}
+		return true
+	}
+	return false
+}
+
+// ips returns the target addresses for the address family
+func (h *hostAddresses) ips(family AddressFamily) []net.IP {
+	var ips []net.IP
+
+	switch family {
+	case AddressFamilyIPv6:
+		if h.v6 != nil {
+			ips = append(ips, h.v6)
+		}
+	case AddressFamilyBoth:
+		if h.v4 != nil {
+			ips = append(ips, h.v4)
+		}
+		if h.v6 != nil {
+			ips = append(ips, h.v6)
+		}
+	case AddressFamilyPreferIPv6:
+		if h.v6 != nil {
+			ips = append(ips, h.v6)
+		} else if h.v4 != nil {
+			ips = append(ips, h.v4)
+		}
+	default:
+		if h.v4 != nil {
+			ips = append(ips, h.v4)
+		}
+	}
+
+	return ips
+}
+
+// missing returns true, if the target addresses of the address family must be requested explicitly.
+// Consul returns only A records in the additional section, so IPv6 addresses of dual-stack targets are requested
+func (h *hostAddresses) missing(family AddressFamily) bool {
+	switch family {
+	case AddressFamilyIPv6, AddressFamilyPreferIPv6:
+		return h.v6 == nil
+	case AddressFamilyBoth:
+		return h.v4 == nil || h.v6 == nil
+	default:
+		return h.v4 == nil
+	}
+}
+
+// lookupTypes returns record types of explicit address requests for the address family
+func lookupTypes(family AddressFamily) []dnsmessage.Type {
+	switch family {
+	case AddressFamilyIPv6:
+		return []dnsmessage.Type{dnsmessage.TypeAAAA}
+	case AddressFamilyBoth:
+		return []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case AddressFamilyPreferIPv6:
+		return []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	default:
+		return []dnsmessage.Type{dnsmessage.TypeA}
+	}
+}
+
+// recordSet indexes address and CNAME records by owner name
+type recordSet struct {
+	cnames    map[string]dnsmessage.Name
+	addresses map[string][]dnsmessage.ResourceBody
+}
+
+func newRecordSet(records []dnsmessage.Resource) *recordSet {
+	s := &recordSet{
+		cnames:    map[string]dnsmessage.Name{},
+		addresses: map[string][]dnsmessage.ResourceBody{},
+	}
+
+	for _, record := range records {
+		name := strings.ToLower(record.Header.Name.String())
+
+		switch b := record.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			s.cnames[name] = b.CNAME
+		case *dnsmessage.AResource, *dnsmessage.AAAAResource:
+			s.addresses[name] = append(s.addresses[name], b)
+		}
+	}
+
+	return s
+}
+
+// resolve follows CNAME chain from the name and adds addresses of the last name in the chain to h.
+// Returns the last name, count of CNAME hops and true, if any address is found
+func (s *recordSet) resolve(name dnsmessage.Name, h *hostAddresses) (dnsmessage.Name, int, bool) {
+	var hops int
+
+	for ; hops < maxCNAMEDepth; hops++ {
+		target, ok := s.cnames[strings.ToLower(name.String())]
+		if !ok {
+			break
+		}
+		name = target
+	}
+
+	bodies := s.addresses[strings.ToLower(name.String())]
+	for _, b := range bodies {
+		h.add(b)
+	}
+
+	return name, hops, len(bodies) > 0
+}
+
+// lookupHost requests addresses of the SRV target with explicit A/AAAA requests
+func (r *ConsulResolver) lookupHost(ctx context.Context, name dnsmessage.Name, h *hostAddresses) error {
+	for _, t := range lookupTypes(r.addressFamily) {
+		if r.addressFamily == AddressFamilyPreferIPv6 && h.v6 != nil {
+			break
+		}
+		// addresses from the additional section are not requested again
+		if (t == dnsmessage.TypeA && h.v4 != nil) || (t == dnsmessage.TypeAAAA && h.v6 != nil) {
+			continue
+		}
+
+		err := r.lookupAddress(ctx, name, t, h)
+		if err != nil {
+			return fmt.Errorf("error get %s records, %w", strings.TrimPrefix(t.String(), "Type"), err)
+		}
+	}
+
+	return nil
+}
+
+// lookupHosts resolves hosts in parallel, not more than lookupConcurrency at once.
+// The first lookup error cancels other lookups and fails the update, unless unresolved targets are dropped
+func (r *ConsulResolver) lookupHosts(ctx context.Context, hosts map[string]dnsmessage.Name, addresses map[string]*hostAddresses) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := r.lookupConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var firstErr error
+
+	for k, v := range hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(k string, v dnsmessage.Name) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			errLookup := r.lookupHost(ctx, v, addresses[k])
+			if errLookup == nil {
+				return
+			}
+
+			if r.dropUnresolved && contextError(ctx) == nil {
+				r.logger.Printf("error resolve target %s, %v", k, errLookup)
+				return
+			}
+
+			mx.Lock()
+			if firstErr == nil {
+				firstErr = errLookup
+				cancel()
+			}
+			mx.Unlock()
+		}(k, v)
+	}
+
+	wg.Wait()
+
+	if errCtx := contextError(ctx); firstErr == nil && errCtx != nil {
+		return errCtx
+	}
+
+	return firstErr
+}
+
+// lookupAddress requests address records with type t and follows CNAME chain up to maxCNAMEDepth hops.
+// Names outside the consul domain are resolved with the external resolver, if it is defined
+func (r *ConsulResolver) lookupAddress(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type, h *hostAddresses) error {
+	var hops int
+
+	for {
+		if r.externalResolver != nil && !r.isConsulName(name) {
+			return r.lookupExternal(ctx, name, t, h)
+		}
+
+		m, err := r.consulRequest(ctx, name, t)
+		if err != nil {
+			return err
+		}
+
+		for _, answer := range m.Answers {
+			switch answer.Body.(type) {
+			case *dnsmessage.AResource, *dnsmessage.AAAAResource, *dnsmessage.CNAMEResource:
+			default:
+				r.logger.Printf("skip unexpected record %T for %s", answer.Body, name.String())
+			}
+		}
+
+		last, n, found := newRecordSet(m.Answers).resolve(name, h)
+		if found || n == 0 {
+			return nil
+		}
+
+		hops += n
+		if hops >= maxCNAMEDepth {
+			return fmt.Errorf("%w, %s", ErrCNAMEChainTooLong, name.String())
+		}
+
+		// the response ends with CNAME record without addresses
+		name = last
+	}
+}
+
+// lookupExternal resolves name outside the consul domain with the external resolver
+func (r *ConsulResolver) lookupExternal(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type, h *hostAddresses) error {
+	network := "ip4"
+	if t == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	ips, err := r.externalResolver.LookupIP(ctx, network, name.String())
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil
+		}
+		return fmt.Errorf("error resolve %s with external resolver, %w", name.String(), err)
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			h.add(&dnsmessage.AResource{A: [4]byte{ip4[0], ip4[1], ip4[2], ip4[3]}})
+			continue
+		}
+		var b [16]byte
+		copy(b[:], ip)
+		h.add(&dnsmessage.AAAAResource{AAAA: b})
+	}
+
+	return nil
+}
+
+// isConsulName returns true for names inside the consul domain
+func (r *ConsulResolver) isConsulName(name dnsmessage.Name) bool {
+	return strings.HasSuffix(strings.ToLower(name.String()), "."+strings.ToLower(r.domain)+".")
+}
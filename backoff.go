@@ -0,0 +1,57 @@
+package go_consul_dns
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff defines delay before the next retry
+type Backoff interface {
+	// Delay returns delay before the retry, attempt starts from 1
+	Delay(attempt int) time.Duration
+}
+
+// ExponentialBackoff is exponential backoff with full jitter. The delay is random value
+// between zero and Base * 2^(attempt-1), but not more than Max
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b ExponentialBackoff) Delay(attempt int) time.Duration {
+	if b.Base <= 0 || attempt < 1 {
+		return 0
+	}
+
+	d := b.Base
+	for i := 1; i < attempt; i++ {
+		if b.Max > 0 && d >= b.Max || d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// sleep waits for the duration or the context cancellation
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
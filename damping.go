@@ -0,0 +1,95 @@
+package go_consul_dns
+
+import "time"
+
+// flapState tracks consecutive updates, in which the endpoint is absent or present
+type flapState struct {
+	absent      int
+	absentSince time.Time
+	present     int
+}
+
+// dampingEnabled returns true, if any flap damping option is defined
+func (r *ConsulResolver) dampingEnabled() bool {
+	return r.dampRemoveAfter > 1 || r.dampRemoveDelay > 0 || r.dampAddAfter > 1
+}
+
+// damp returns endpoints for publishing: endpoints absent in the update are kept until they are absent
+// for dampRemoveAfter updates and dampRemoveDelay duration, new endpoints are added after they are present
+// for dampAddAfter updates. It is called only from update
+func (r *ConsulResolver) damp(endpoints []Endpoint) []Endpoint {
+	if !r.dampingEnabled() {
+		return endpoints
+	}
+
+	if r.flaps == nil {
+		r.flaps = map[string]*flapState{}
+	}
+
+	prev := r.load().Endpoints
+	now := time.Now()
+
+	published := make(map[string]struct{}, len(prev))
+	for _, e := range prev {
+		published[e.Address] = struct{}{}
+	}
+	resolved := make(map[string]struct{}, len(endpoints))
+
+	result := make([]Endpoint, 0, len(endpoints))
+
+	for _, e := range endpoints {
+		resolved[e.Address] = struct{}{}
+
+		if _, ok := published[e.Address]; ok || len(prev) == 0 {
+			delete(r.flaps, e.Address)
+			result = append(result, e)
+			continue
+		}
+
+		state := r.flapState(e.Address)
+		state.absent = 0
+		state.present++
+		if state.present >= r.dampAddAfter {
+			delete(r.flaps, e.Address)
+			result = append(result, e)
+		}
+	}
+
+	for _, e := range prev {
+		if _, ok := resolved[e.Address]; ok {
+			continue
+		}
+
+		state := r.flapState(e.Address)
+		state.present = 0
+		if state.absent == 0 {
+			state.absentSince = now
+		}
+		state.absent++
+		if state.absent >= r.dampRemoveAfter && now.Sub(state.absentSince) >= r.dampRemoveDelay {
+			delete(r.flaps, e.Address)
+			continue
+		}
+		result = append(result, e)
+	}
+
+	// forget endpoints, which are pending for adding and disappeared again
+	for address := range r.flaps {
+		_, isPublished := published[address]
+		_, isResolved := resolved[address]
+		if !isPublished && !isResolved {
+			delete(r.flaps, address)
+		}
+	}
+
+	return result
+}
+
+func (r *ConsulResolver) flapState(address string) *flapState {
+	state, ok := r.flaps[address]
+	if !ok {
+		state = &flapState{}
+		r.flaps[address] = state
+	}
+	return state
+}
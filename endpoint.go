@@ -0,0 +1,31 @@
+package go_consul_dns
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Endpoint is a service instance resolved from SRV record
+type Endpoint struct {
+	// Address is the instance address in 'host:port' form, the same value as returned by All
+	Address string
+	IP      net.IP
+	Port    uint16
+	// Target is the SRV record target host name, like 'node1.node.dc1.consul.'
+	Target   string
+	Priority uint16
+	Weight   uint16
+	// TTL is the SRV record TTL
+	TTL time.Duration
+}
+
+// Node returns consul node name from the SRV target like 'node1.node.dc1.consul.'
+// or empty string, if the target is not a node name
+func (e Endpoint) Node() string {
+	idx := strings.Index(e.Target, ".node.")
+	if idx <= 0 {
+		return ""
+	}
+	return e.Target[:idx]
+}
@@ -0,0 +1,127 @@
+package go_consul_dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// ErrFrameTooLarge is returned when the length prefix of a DNS over TCP message exceeds the allowed message size
+	ErrFrameTooLarge = errors.New("dns frame too large")
+	// ErrFrameTruncated is returned when a DNS over TCP message ends before the length from its prefix is read
+	ErrFrameTruncated = errors.New("dns frame truncated")
+	// ErrResponseMismatch is returned when the response ID or question does not match the request
+	ErrResponseMismatch = errors.New("dns response does not match request")
+
+	// ErrNoSuchService is matched by RCodeError with NXDOMAIN response code
+	ErrNoSuchService = errors.New("no such service")
+	// ErrServerFailure is matched by RCodeError with SERVFAIL response code
+	ErrServerFailure = errors.New("dns server failure")
+	// ErrRefused is matched by RCodeError with REFUSED response code
+	ErrRefused = errors.New("dns query refused")
+	// ErrTimeout is returned when dial, write or read operation exceeds the timeout
+	ErrTimeout = errors.New("dns request timeout")
+	// ErrMaxAttempts is matched by AttemptsError
+	ErrMaxAttempts = errors.New("max attempts reached")
+	// ErrCNAMEChainTooLong is returned when CNAME chain of SRV target exceeds the depth limit
+	ErrCNAMEChainTooLong = errors.New("cname chain too long")
+	// ErrUpdateRejected is returned when the update is rejected by the update guard
+	ErrUpdateRejected = errors.New("update rejected")
+	// ErrStale is returned by NextAddress and RandomAddress when the data is older than max stale duration
+	ErrStale = errors.New("data is stale")
+	// ErrNoEndpoints is returned by NextAddress and RandomAddress when the cache is empty
+	ErrNoEndpoints = errors.New("no endpoints")
+	// ErrClosed is returned by updates after the resolver is closed
+	ErrClosed = errors.New("resolver is closed")
+)
+
+// RCodeError is returned when consul responds with non-success response code
+type RCodeError struct {
+	Name  string
+	RCode dnsmessage.RCode
+}
+
+func (e *RCodeError) Error() string {
+	return fmt.Sprintf("unexpected response code %s for %s", e.RCode, e.Name)
+}
+
+// Is allows to match RCodeError with ErrNoSuchService, ErrServerFailure and ErrRefused
+func (e *RCodeError) Is(target error) bool {
+	switch e.RCode {
+	case dnsmessage.RCodeNameError:
+		return target == ErrNoSuchService
+	case dnsmessage.RCodeServerFailure:
+		return target == ErrServerFailure
+	case dnsmessage.RCodeRefused:
+		return target == ErrRefused
+	}
+	return false
+}
+
+// AttemptsError is returned when all request attempts are failed. It wraps the error of the last attempt
+type AttemptsError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *AttemptsError) Error() string {
+	if e.Err == nil {
+		return ErrMaxAttempts.Error()
+	}
+	return fmt.Sprintf("%s (%d), %v", ErrMaxAttempts.Error(), e.Attempts, e.Err)
+}
+
+// Is allows to match AttemptsError with ErrMaxAttempts
+func (e *AttemptsError) Is(target error) bool {
+	return target == ErrMaxAttempts
+}
+
+func (e *AttemptsError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned when dial, write or read operation is timed out. It wraps the network error
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s, %v", ErrTimeout.Error(), e.Err)
+}
+
+// Is allows to match TimeoutError with ErrTimeout
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// wrapTimeout marks network timeout errors with ErrTimeout
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Err: err}
+	}
+	return err
+}
+
+// joinErrors returns nil for empty errors, the single error or an error with all messages
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	msg := errs[0].Error()
+	for _, err := range errs[1:] {
+		msg += "; " + err.Error()
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,89 @@
+package go_consul_dns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsHeaderLen is the size of the fixed DNS message header
+const dnsHeaderLen = 12
+
+// readFrame reads one DNS message prefixed with two-byte length (RFC 1035 4.2.2, RFC 7766 8)
+func readFrame(rd io.Reader, maxSize int) ([]byte, error) {
+	var prefix [2]byte
+
+	if _, err := io.ReadFull(rd, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w, incomplete length prefix", ErrFrameTruncated)
+		}
+		return nil, err
+	}
+
+	l := int(prefix[0])<<8 | int(prefix[1])
+	if l > maxSize {
+		return nil, fmt.Errorf("%w, length %d, max %d", ErrFrameTooLarge, l, maxSize)
+	}
+	if l < dnsHeaderLen {
+		return nil, fmt.Errorf("%w, length %d is less than header length", ErrFrameTruncated, l)
+	}
+
+	msg := make([]byte, l)
+
+	n, err := io.ReadFull(rd, msg)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w, read %d of %d bytes", ErrFrameTruncated, n, l)
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// buildQuery returns length-prefixed DNS query message with single question
+func buildQuery(id uint16, q dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: id})
+	if err := b.StartQuestions(); err != nil {
+		return nil, fmt.Errorf("error build message, start questions, %w", err)
+	}
+	if err := b.Question(q); err != nil {
+		return nil, fmt.Errorf("error build message, add question, %w", err)
+	}
+	req, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("error build message, finish, %w", err)
+	}
+
+	l := len(req) - 2
+	req[0] = byte(l >> 8)
+	req[1] = byte(l)
+
+	return req, nil
+}
+
+// checkResponse verifies that the response message answers the query with given id and question
+func checkResponse(m *dnsmessage.Message, id uint16, q dnsmessage.Question) error {
+	if !m.Header.Response {
+		return fmt.Errorf("%w, message is not a response", ErrResponseMismatch)
+	}
+	if m.Header.ID != id {
+		return fmt.Errorf("%w, id %d, expect %d", ErrResponseMismatch, m.Header.ID, id)
+	}
+	if len(m.Questions) != 1 {
+		return fmt.Errorf("%w, questions count %d, expect 1", ErrResponseMismatch, len(m.Questions))
+	}
+
+	rq := m.Questions[0]
+	if !strings.EqualFold(rq.Name.String(), q.Name.String()) {
+		return fmt.Errorf("%w, question name %s, expect %s", ErrResponseMismatch, rq.Name.String(), q.Name.String())
+	}
+	if rq.Type != q.Type {
+		return fmt.Errorf("%w, question type %s, expect %s", ErrResponseMismatch, rq.Type, q.Type)
+	}
+
+	return nil
+}
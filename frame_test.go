@@ -0,0 +1,106 @@
+package go_consul_dns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func frame(l int, payload []byte) []byte {
+	return append([]byte{byte(l >> 8), byte(l)}, payload...)
+}
+
+func TestReadFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 1024)
+
+	b, err := readFrame(bytes.NewReader(frame(len(payload), payload)), defaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatal("unexpected payload")
+	}
+}
+
+func TestReadFrame_Split(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 3000)
+
+	b, err := readFrame(iotest.OneByteReader(bytes.NewReader(frame(len(payload), payload))), defaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatal("unexpected payload")
+	}
+}
+
+func TestReadFrame_TooLarge(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 100)
+
+	_, err := readFrame(bytes.NewReader(frame(len(payload), payload)), 99)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestReadFrame_Truncated(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 100)
+
+	_, err := readFrame(bytes.NewReader(frame(200, payload)), defaultMaxMessageSize)
+	if !errors.Is(err, ErrFrameTruncated) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	_, err = readFrame(bytes.NewReader([]byte{1}), defaultMaxMessageSize)
+	if !errors.Is(err, ErrFrameTruncated) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	_, err = readFrame(bytes.NewReader(frame(2, []byte{1, 2})), defaultMaxMessageSize)
+	if !errors.Is(err, ErrFrameTruncated) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestReadFrame_EOF(t *testing.T) {
+	_, err := readFrame(bytes.NewReader(nil), defaultMaxMessageSize)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("foo.service.dc1.consul."), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}
+
+	m := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, Response: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("FOO.service.dc1.consul."), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}
+	if err := checkResponse(m, 42, q); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if err := checkResponse(m, 43, q); !errors.Is(err, ErrResponseMismatch) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	m.Questions[0].Name = dnsmessage.MustNewName("bar.service.dc1.consul.")
+	if err := checkResponse(m, 42, q); !errors.Is(err, ErrResponseMismatch) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	m.Questions[0].Name = q.Name
+	m.Questions[0].Type = dnsmessage.TypeA
+	if err := checkResponse(m, 42, q); !errors.Is(err, ErrResponseMismatch) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	m.Questions = nil
+	if err := checkResponse(m, 42, q); !errors.Is(err, ErrResponseMismatch) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
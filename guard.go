@@ -0,0 +1,57 @@
+package go_consul_dns
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// apply stores the endpoints, if they pass the update guard. The guard is checked before the flap damping,
+// so the rejected update does not change the damping state
+func (r *ConsulResolver) apply(endpoints []Endpoint) error {
+	if err := r.checkGuard(endpoints); err != nil {
+		atomic.AddInt64(&r.rejectedUpdates, 1)
+		r.logger.Printf("update rejected, %v", err)
+		return err
+	}
+
+	r.store(r.damp(endpoints))
+
+	return nil
+}
+
+// checkGuard returns an error, if the update removes too many endpoints and this condition
+// does not persist for guardConfirmations consecutive updates. It is called only from update
+func (r *ConsulResolver) checkGuard(endpoints []Endpoint) error {
+	if r.guardMaxRemovedPercent <= 0 && r.guardMinEndpoints <= 0 {
+		return nil
+	}
+
+	prev := r.load().Endpoints
+	if len(prev) == 0 {
+		return nil
+	}
+
+	var reason string
+
+	_, removed := diffEndpoints(prev, endpoints)
+	if r.guardMaxRemovedPercent > 0 && len(removed)*100 > r.guardMaxRemovedPercent*len(prev) {
+		reason = fmt.Sprintf("removes %d of %d endpoints", len(removed), len(prev))
+	}
+	if r.guardMinEndpoints > 0 && len(endpoints) < r.guardMinEndpoints && len(endpoints) < len(prev) {
+		reason = fmt.Sprintf("leaves %d endpoints, min %d", len(endpoints), r.guardMinEndpoints)
+	}
+
+	if reason == "" {
+		r.guardRejects = 0
+		return nil
+	}
+
+	r.guardRejects++
+	if r.guardRejects >= r.guardConfirmations {
+		r.logger.Printf("update %s, applied after %d consecutive updates", reason, r.guardRejects)
+		r.guardRejects = 0
+		return nil
+	}
+
+	return fmt.Errorf("%w, update %s, %d of %d consecutive updates", ErrUpdateRejected, reason, r.guardRejects, r.guardConfirmations)
+}
@@ -2,7 +2,9 @@ package go_consul_dns
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"testing"
@@ -21,15 +23,22 @@ func TestIntegration_inUpdate(t *testing.T) {
 	}
 	defer r.Close()
 
-	r.inUpdate = 1
+	r.callMx.Lock()
+	c := r.startCall()
+	r.callMx.Unlock()
+	defer r.finishCall(c, nil)
 
-	errUpdate := r.Update()
+	started, errUpdate := r.TryUpdate(context.Background())
 	if errUpdate != nil {
 		t.Error(errUpdate)
 		return
 	}
+	if started {
+		t.Errorf("unexpected update is started")
+		return
+	}
 
-	if len(r.data) != 0 {
+	if len(r.All()) != 0 {
 		t.Errorf("unexpcted data len")
 	}
 }
@@ -48,8 +57,8 @@ func TestIntegration_notExistsService(t *testing.T) {
 	defer r.Close()
 
 	errUpdate := r.Update()
-	if errUpdate != nil {
-		t.Error(errUpdate)
+	if !errors.Is(errUpdate, ErrNoSuchService) {
+		t.Errorf("unexpected error, %v", errUpdate)
 		return
 	}
 
@@ -0,0 +1,371 @@
+package go_consul_dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errMuxClosed = errors.New("pipelined connection is closed")
+
+// maxMuxTimeouts is a count of consecutive query timeouts without any response, after which
+// the shared connection is dropped
+const maxMuxTimeouts = 3
+
+// Transport is pipelined connections to consul, which can be shared by many resolvers with WithTransport.
+// Concurrent queries of all resolvers are sent over the same connections
+type Transport struct {
+	address        string
+	timeout        time.Duration
+	maxMessageSize int
+	logger         Logger
+
+	mux *muxTransport
+}
+
+// TransportOption allows to redefine Transport settings
+type TransportOption func(t *Transport)
+
+// WithTransportTimeout allows to redefine dial timeout of the transport connections
+func WithTransportTimeout(timeout time.Duration) TransportOption {
+	return func(t *Transport) {
+		t.timeout = timeout
+	}
+}
+
+// WithTransportMaxMessageSize allows to redefine max size of DNS response message, read from the transport connections
+func WithTransportMaxMessageSize(n int) TransportOption {
+	return func(t *Transport) {
+		t.maxMessageSize = n
+	}
+}
+
+// WithTransportLogger allows to define logger of the transport
+func WithTransportLogger(logger Logger) TransportOption {
+	return func(t *Transport) {
+		t.logger = logger
+	}
+}
+
+// NewTransport creates pipelined transport with conns shared connections to the consul address.
+// Connections are dialed on the first query. The transport must be closed after all resolvers, which use it
+func NewTransport(address string, conns int, opts ...TransportOption) *Transport {
+	if conns < 1 {
+		conns = 1
+	}
+
+	t := &Transport{
+		address:        address,
+		timeout:        defaultTimeout,
+		maxMessageSize: defaultMaxMessageSize,
+		logger:         &nopLogger{},
+	}
+
+	for _, o := range opts {
+		o(t)
+	}
+
+	t.mux = newMuxTransport(t.dial, conns, t.maxMessageSize, t.logger)
+
+	return t
+}
+
+// Close closes connections of the transport
+func (t *Transport) Close() error {
+	return t.mux.close()
+}
+
+func (t *Transport) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: t.timeout}
+	return d.DialContext(ctx, "tcp", t.address)
+}
+
+// muxTransport sends concurrent queries over a few shared TCP connections (RFC 7766, section 6.2.1.1).
+// Responses are dispatched to the waiting queries by message ID
+type muxTransport struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	maxSize int
+	logger  Logger
+
+	// dialMx serializes dials, so concurrent queries do not dial the same slot twice
+	dialMx sync.Mutex
+
+	mx     sync.Mutex
+	conns  []*muxConn
+	next   int
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type muxResult struct {
+	res []byte
+	err error
+}
+
+// muxConn is a shared connection with a reader goroutine
+type muxConn struct {
+	conn net.Conn
+
+	writeMx sync.Mutex
+
+	mx      sync.Mutex
+	pending map[uint16]chan muxResult
+	err     error
+	// timeouts is a count of consecutive query timeouts, it is reset by any response
+	timeouts int
+}
+
+func newMuxTransport(dial func(ctx context.Context) (net.Conn, error), conns, maxSize int, logger Logger) *muxTransport {
+	return &muxTransport{
+		dial:    dial,
+		maxSize: maxSize,
+		logger:  logger,
+		conns:   make([]*muxConn, conns),
+	}
+}
+
+// exchange sends the query over the shared connection and waits for the response with the same ID
+// until the deadline or the context cancellation. It returns the response and the query ID
+func (t *muxTransport) exchange(ctx context.Context, q dnsmessage.Question, deadline time.Time) ([]byte, uint16, error) {
+	c, errConn := t.conn(ctx)
+	if errConn != nil {
+		return nil, 0, fmt.Errorf("error get connection, %w", wrapTimeout(errConn))
+	}
+
+	id, ch, errRegister := c.register()
+	if errRegister != nil {
+		return nil, 0, errRegister
+	}
+
+	req, errBuild := buildQuery(id, q)
+	if errBuild != nil {
+		c.unregister(id)
+		return nil, 0, errBuild
+	}
+
+	if errWrite := c.write(req, deadline); errWrite != nil {
+		// partially written query breaks the stream for all queries
+		c.fail(errWrite)
+		return nil, 0, fmt.Errorf("error write to connection, %w", wrapTimeout(errWrite))
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case result := <-ch:
+		if result.err != nil {
+			return nil, 0, fmt.Errorf("error read from connection, %w", wrapTimeout(result.err))
+		}
+		return result.res, id, nil
+	case <-ctx.Done():
+		// the late response is dropped by the reader
+		c.unregister(id)
+		return nil, 0, ctx.Err()
+	case <-timer.C:
+		if errCtx := contextError(ctx); errCtx != nil {
+			c.unregister(id)
+			return nil, 0, errCtx
+		}
+		err := fmt.Errorf("%w, no response before deadline", ErrTimeout)
+		// other queries on the shared connection are not failed by a single timeout,
+		// the connection is dropped only after repeated timeouts, it may be half-open
+		if c.timeout(id) {
+			c.fail(err)
+		}
+		return nil, 0, err
+	}
+}
+
+// conn returns the next shared connection in round-robin order, broken connections are redialed
+func (t *muxTransport) conn(ctx context.Context) (*muxConn, error) {
+	t.mx.Lock()
+	if t.closed {
+		t.mx.Unlock()
+		return nil, errMuxClosed
+	}
+	slot := t.next % len(t.conns)
+	t.next++
+	c := t.conns[slot]
+	t.mx.Unlock()
+
+	if c != nil && c.alive() {
+		return c, nil
+	}
+
+	t.dialMx.Lock()
+	defer t.dialMx.Unlock()
+
+	// the slot may be redialed by concurrent query
+	t.mx.Lock()
+	c = t.conns[slot]
+	t.mx.Unlock()
+	if c != nil && c.alive() {
+		return c, nil
+	}
+
+	conn, errDial := t.dial(ctx)
+	if errDial != nil {
+		return nil, errDial
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.closed {
+		_ = conn.Close()
+		return nil, errMuxClosed
+	}
+
+	c = &muxConn{
+		conn:    conn,
+		pending: map[uint16]chan muxResult{},
+	}
+	t.conns[slot] = c
+
+	t.wg.Add(1)
+	go t.read(c)
+
+	return c, nil
+}
+
+// read dispatches responses to the waiting queries until the connection is broken
+func (t *muxTransport) read(c *muxConn) {
+	defer t.wg.Done()
+
+	for {
+		res, err := readFrame(c.conn, t.maxSize)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		id := binary.BigEndian.Uint16(res)
+
+		c.mx.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.timeouts = 0
+		c.mx.Unlock()
+
+		if !ok {
+			t.logger.Printf("drop response with unexpected id %d", id)
+			continue
+		}
+
+		ch <- muxResult{res: res}
+	}
+}
+
+// close closes all shared connections and waits for the reader goroutines
+func (t *muxTransport) close() error {
+	t.mx.Lock()
+	if t.closed {
+		t.mx.Unlock()
+		return nil
+	}
+	t.closed = true
+	conns := t.conns
+	t.mx.Unlock()
+
+	var errs []error
+	for _, c := range conns {
+		if c == nil {
+			continue
+		}
+		if err := c.fail(errMuxClosed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	t.wg.Wait()
+
+	return joinErrors(errs)
+}
+
+func (c *muxConn) alive() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.err == nil
+}
+
+// register allocates unused message ID for the query
+func (c *muxConn) register() (uint16, chan muxResult, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	if len(c.pending) >= 1<<16 {
+		return 0, nil, errors.New("no free message id")
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	for {
+		if _, ok := c.pending[id]; !ok {
+			break
+		}
+		id++
+	}
+
+	ch := make(chan muxResult, 1)
+	c.pending[id] = ch
+
+	return id, ch, nil
+}
+
+func (c *muxConn) unregister(id uint16) {
+	c.mx.Lock()
+	delete(c.pending, id)
+	c.mx.Unlock()
+}
+
+// timeout unregisters timed out query and returns true, if the connection has too many consecutive timeouts
+func (c *muxConn) timeout(id uint16) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	delete(c.pending, id)
+	c.timeouts++
+
+	return c.timeouts >= maxMuxTimeouts
+}
+
+func (c *muxConn) write(req []byte, deadline time.Time) error {
+	c.writeMx.Lock()
+	defer c.writeMx.Unlock()
+
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(req)
+	return err
+}
+
+// fail closes the connection and returns the error to all waiting queries. Only the first call closes the connection
+func (c *muxConn) fail(err error) error {
+	c.mx.Lock()
+	if c.err != nil {
+		c.mx.Unlock()
+		return nil
+	}
+	c.err = err
+	pending := c.pending
+	c.pending = nil
+	c.mx.Unlock()
+
+	for _, ch := range pending {
+		ch <- muxResult{err: err}
+	}
+
+	return c.conn.Close()
+}
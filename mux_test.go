@@ -0,0 +1,293 @@
+package go_consul_dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startReorderServer accepts connections, reads batch requests and responds to them in reverse order
+func startReorderServer(t *testing.T, batch int, handler func(req *dnsmessage.Message) *dnsmessage.Message) (string, *int64) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listen address, %v", err)
+	}
+
+	var conns int64
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	active := map[net.Conn]struct{}{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, errAccept := ln.Accept()
+			if errAccept != nil {
+				return
+			}
+			atomic.AddInt64(&conns, 1)
+			mx.Lock()
+			active[conn] = struct{}{}
+			mx.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+
+				for {
+					var reqs []*dnsmessage.Message
+					for len(reqs) < batch {
+						b, errRead := readFrame(conn, defaultMaxMessageSize)
+						if errRead != nil {
+							return
+						}
+						req := &dnsmessage.Message{}
+						if errRead = req.Unpack(b); errRead != nil {
+							return
+						}
+						reqs = append(reqs, req)
+					}
+
+					for i := len(reqs) - 1; i >= 0; i-- {
+						resp := handler(reqs[i])
+						resp.Header.Response = true
+						res, errPack := resp.AppendPack(make([]byte, 2, 514))
+						if errPack != nil {
+							return
+						}
+						res[0] = byte((len(res) - 2) >> 8)
+						res[1] = byte(len(res) - 2)
+						if _, errWrite := conn.Write(res); errWrite != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+		mx.Lock()
+		for conn := range active {
+			_ = conn.Close()
+		}
+		mx.Unlock()
+		wg.Wait()
+	})
+
+	return ln.Addr().String(), &conns
+}
+
+func TestPipelining_OutOfOrder(t *testing.T) {
+	const queries = 5
+
+	addr, conns := startReorderServer(t, queries, serviceHandler(queries, queries))
+
+	r, err := New("service", WithConsulAddress(addr), WithPipelining(1), WithMaxRequestAttempts(1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, queries)
+
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := dnsmessage.MustNewName(fmt.Sprintf("node%d.node.dc1.consul.", i))
+			m, errRequest := r.consulRequest(context.Background(), name, dnsmessage.TypeA)
+			if errRequest != nil {
+				errs <- errRequest
+				return
+			}
+			a, ok := m.Answers[0].Body.(*dnsmessage.AResource)
+			if !ok || a.A != [4]byte{10, 0, 0, byte(i + 1)} {
+				errs <- fmt.Errorf("unexpected answer %v for %s", m.Answers[0].Body, name)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for e := range errs {
+		t.Error(e)
+	}
+
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Fatalf("unexpected connections count %d, expect 1", n)
+	}
+}
+
+func TestPipelining_Update(t *testing.T) {
+	s := startTestServer(t, serviceHandler(9, 3))
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithPipelining(2))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		if err = r.Update(); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+
+	if len(r.All()) != 9 {
+		t.Fatalf("unexpected addresses count %d, expect 9", len(r.All()))
+	}
+	if n := atomic.LoadInt64(&s.conns); n != 2 {
+		t.Fatalf("unexpected connections count %d, expect 2", n)
+	}
+}
+
+func TestPipelining_Timeout(t *testing.T) {
+	// the server reads requests, but never responds
+	addr, conns := startReorderServer(t, 1<<16, serviceHandler(1, 1))
+
+	r, err := New("service", WithConsulAddress(addr), WithPipelining(1), WithTimeout(time.Millisecond*50), WithMaxRequestAttempts(maxMuxTimeouts+1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	err = r.Update()
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, ErrMaxAttempts) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrTimeout)
+	}
+
+	// the connection is dropped after repeated timeouts and redialed
+	if n := atomic.LoadInt64(conns); n != 2 {
+		t.Fatalf("unexpected connections count %d, expect 2", n)
+	}
+}
+
+func TestTransport_TimeoutDoesNotFailOthers(t *testing.T) {
+	handler := serviceHandler(3, 3)
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		time.Sleep(time.Millisecond * 150)
+		return handler(req)
+	})
+
+	tr := NewTransport(s.addr(), 1, WithTransportTimeout(time.Second))
+	defer tr.Close()
+
+	short, err := New("foo", WithTransport(tr), WithTimeout(time.Millisecond*50), WithMaxRequestAttempts(1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer short.Close()
+
+	long, err := New("bar", WithTransport(tr), WithTimeout(time.Second*5), WithMaxRequestAttempts(1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer long.Close()
+
+	errLong := make(chan error, 1)
+	go func() {
+		errLong <- long.Update()
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+
+	if err = short.Update(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrTimeout)
+	}
+	if err = <-errLong; err != nil {
+		t.Fatalf("unexpected error of other resolver, %v", err)
+	}
+	if n := atomic.LoadInt64(&s.conns); n != 1 {
+		t.Fatalf("unexpected connections count %d, expect 1", n)
+	}
+}
+
+func TestPipelining_Cancel(t *testing.T) {
+	addr, _ := startReorderServer(t, 1<<16, serviceHandler(1, 1))
+
+	r, err := New("service", WithConsulAddress(addr), WithPipelining(1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err = r.UpdateContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v, expect %v", err, context.DeadlineExceeded)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err = r.Update(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrClosed)
+	}
+}
+
+func TestTransport_Shared(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 3))
+
+	tr := NewTransport(s.addr(), 1)
+
+	r1, err := New("foo", WithTransport(tr), WithMaxRequestAttempts(1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	r2, err := New("bar", WithTransport(tr), WithMaxRequestAttempts(1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r2.Close()
+
+	var wg sync.WaitGroup
+	for _, r := range []*ConsulResolver{r1, r2} {
+		wg.Add(1)
+		go func(r *ConsulResolver) {
+			defer wg.Done()
+			if errUpdate := r.Update(); errUpdate != nil {
+				t.Errorf("unexpected error, %v", errUpdate)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if len(r1.All()) != 3 || len(r2.All()) != 3 {
+		t.Fatalf("unexpected addresses %v, %v", r1.All(), r2.All())
+	}
+	if n := atomic.LoadInt64(&s.conns); n != 1 {
+		t.Fatalf("unexpected connections count %d, expect 1", n)
+	}
+
+	// closing the resolver does not close the shared transport
+	if err = r1.Close(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err = r2.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if err = tr.Close(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err = r2.Update(); !errors.Is(err, errMuxClosed) {
+		t.Fatalf("unexpected error %v, expect %v", err, errMuxClosed)
+	}
+}
@@ -1,6 +1,10 @@
 package go_consul_dns
 
-import "time"
+import (
+	"context"
+	"net"
+	"time"
+)
 
 // Option is init options type
 type Option func(r *ConsulResolver)
@@ -47,9 +51,194 @@ func WithMaxRequestAttempts(n int) Option {
 	}
 }
 
-// WithGetAddressFromSRV allows to define get service address from SRV record and do not send A requests
+// WithGetAddressFromSRV allows to define get service address from SRV record and do not send A requests.
+// Targets which are not addr-encoded, like '7f000001.addr.dc1.consul.', are resolved with A/AAAA requests
 func WithGetAddressFromSRV() Option {
 	return func(r *ConsulResolver) {
 		r.getAddressFromSRV = true
 	}
 }
+
+// WithMaxMessageSize allows to redefine max size of DNS response message. Larger responses are rejected with ErrFrameTooLarge
+func WithMaxMessageSize(n int) Option {
+	return func(r *ConsulResolver) {
+		r.maxMessageSize = n
+	}
+}
+
+// WithKeepDataOnNoSuchService allows to keep the last resolved addresses when consul responds with NXDOMAIN.
+// By default, the addresses are cleared. Update returns an error matched with ErrNoSuchService in both cases
+func WithKeepDataOnNoSuchService() Option {
+	return func(r *ConsulResolver) {
+		r.keepOnNoSuchService = true
+	}
+}
+
+// WithAddressFamily allows to redefine which addresses of SRV targets are resolved. By default, only IPv4 addresses
+func WithAddressFamily(family AddressFamily) Option {
+	return func(r *ConsulResolver) {
+		r.addressFamily = family
+	}
+}
+
+// WithExternalResolver allows to define resolver for CNAME targets outside the consul domain,
+// like hostnames of consul external services. Use net.DefaultResolver for the system resolver.
+// By default, all names are requested from consul
+func WithExternalResolver(resolver *net.Resolver) Option {
+	return func(r *ConsulResolver) {
+		r.externalResolver = resolver
+	}
+}
+
+// WithAutoUpdate allows to start background goroutine, which calls Update every interval plus random jitter.
+// Update errors are logged with the Logger. The goroutine is stopped by Close
+func WithAutoUpdate(interval, jitter time.Duration) Option {
+	return func(r *ConsulResolver) {
+		r.autoUpdateInterval = interval
+		r.autoUpdateJitter = jitter
+	}
+}
+
+// WithOnChange allows to define callback, which is called by Update when endpoints are added or removed.
+// Endpoints are compared by address with the previous published state. The callback is called synchronously
+// from Update after the update is finished and should not block. Calling Update or Close from the callback is not allowed
+func WithOnChange(fn func(added, removed []Endpoint)) Option {
+	return func(r *ConsulResolver) {
+		r.onChange = fn
+	}
+}
+
+// WithUpdateGuard allows to protect the cache from mass deregistration. The update is rejected with ErrUpdateRejected,
+// if it removes more than maxRemovedPercent of endpoints or leaves less than minEndpoints endpoints.
+// The update is applied, if this condition persists for confirmations consecutive updates.
+// Confirmations less than 2 are replaced with 2, so the first offending update is always rejected.
+// Zero maxRemovedPercent or minEndpoints disables the check
+func WithUpdateGuard(maxRemovedPercent, minEndpoints, confirmations int) Option {
+	return func(r *ConsulResolver) {
+		if confirmations < 2 {
+			confirmations = 2
+		}
+		r.guardMaxRemovedPercent = maxRemovedPercent
+		r.guardMinEndpoints = minEndpoints
+		r.guardConfirmations = confirmations
+	}
+}
+
+// WithFlapDamping allows to damp endpoints, which disappear intermittently. The endpoint missing in the update
+// is removed after it is absent for removeAfter consecutive updates and at least removeDelay duration.
+// The new endpoint is added after it is present for addAfter consecutive updates
+func WithFlapDamping(removeAfter int, removeDelay time.Duration, addAfter int) Option {
+	return func(r *ConsulResolver) {
+		r.dampRemoveAfter = removeAfter
+		r.dampRemoveDelay = removeDelay
+		r.dampAddAfter = addAfter
+	}
+}
+
+// WithMaxStale allows to define max age of the data since the last successful update.
+// NextAddress and RandomAddress return ErrStale for older data. Next and Random are not affected
+func WithMaxStale(d time.Duration) Option {
+	return func(r *ConsulResolver) {
+		r.maxStale = d
+	}
+}
+
+// WithWaitForEndpoints allows New to block until at least count endpoints are resolved.
+// New returns an error, if the context is done before
+func WithWaitForEndpoints(ctx context.Context, count int) Option {
+	return func(r *ConsulResolver) {
+		r.waitCtx = ctx
+		r.waitMin = count
+	}
+}
+
+// WithTTLRefresh allows to start background goroutine like WithAutoUpdate, but the next update is scheduled
+// after the min TTL of SRV and address records from the last response, clamped between minInterval and maxInterval.
+// The jitter from WithAutoUpdate is added, if it is defined. Zero minInterval means 1 second
+func WithTTLRefresh(minInterval, maxInterval time.Duration) Option {
+	return func(r *ConsulResolver) {
+		r.ttlRefresh = true
+		r.ttlRefreshMin = minInterval
+		r.ttlRefreshMax = maxInterval
+	}
+}
+
+// WithBackoff allows to define delay between request attempts and between failed background updates.
+// By default, attempts are retried without delay and failed background updates are retried after the regular interval.
+// The backoff delay of background updates is used only if it is longer than the regular interval
+func WithBackoff(b Backoff) Option {
+	return func(r *ConsulResolver) {
+		r.backoff = b
+	}
+}
+
+// WithMaxIdleConns allows to redefine max count of idle connections in the pool. Zero value means no limit
+func WithMaxIdleConns(n int) Option {
+	return func(r *ConsulResolver) {
+		r.maxIdleConns = n
+	}
+}
+
+// WithMaxOpenConns allows to define max count of open connections. Requests wait for released connection,
+// if the limit is reached. By default, there is no limit
+func WithMaxOpenConns(n int) Option {
+	return func(r *ConsulResolver) {
+		r.maxOpenConns = n
+	}
+}
+
+// WithConnIdleTimeout allows to redefine max duration of idle connection in the pool. Zero value means no limit
+func WithConnIdleTimeout(d time.Duration) Option {
+	return func(r *ConsulResolver) {
+		r.connIdleTimeout = d
+	}
+}
+
+// WithConnMaxLifetime allows to define max duration since the connection is dialed. By default, there is no limit
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(r *ConsulResolver) {
+		r.connMaxLifetime = d
+	}
+}
+
+// WithPipelining enables pipelined mode: concurrent queries are sent over conns shared connections
+// and responses are matched by message ID. Connection pool options are not used in this mode
+func WithPipelining(conns int) Option {
+	return func(r *ConsulResolver) {
+		r.pipelineConns = conns
+	}
+}
+
+// WithLookupConcurrency allows to redefine max count of parallel address requests for SRV targets,
+// which are missing in the additional section. Default is 4
+func WithLookupConcurrency(n int) Option {
+	return func(r *ConsulResolver) {
+		r.lookupConcurrency = n
+	}
+}
+
+// WithDropUnresolvedTargets allows to apply the update without targets, which are failed to resolve.
+// Failed targets are logged. By default, the update is failed
+func WithDropUnresolvedTargets() Option {
+	return func(r *ConsulResolver) {
+		r.dropUnresolved = true
+	}
+}
+
+// WithUDP enables queries over UDP with EDNS0 buffer size. Truncated responses are repeated over TCP.
+// The size is limited by 512 and the max message size
+func WithUDP(bufferSize int) Option {
+	return func(r *ConsulResolver) {
+		r.udpSize = bufferSize
+	}
+}
+
+// WithTransport allows to send queries over the pipelined transport, which is shared with other resolvers.
+// The transport address is used instead of WithConsulAddress. WithTimeout limits queries of the resolver,
+// dial timeout, max message size and logger of the connections are defined by TransportOption.
+// Close does not close the shared transport
+func WithTransport(t *Transport) Option {
+	return func(r *ConsulResolver) {
+		r.transport = t
+	}
+}
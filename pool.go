@@ -0,0 +1,233 @@
+package go_consul_dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errPoolClosed = errors.New("connection pool is closed")
+
+// PoolStats contains connection pool counters
+type PoolStats struct {
+	// Open is a count of open connections, idle and in use
+	Open int
+	// Idle is a count of idle connections in the pool
+	Idle int
+	// Dialed is a count of dialed connections
+	Dialed int64
+	// Reused is a count of connections taken from the pool
+	Reused int64
+	// Discarded is a count of connections closed by errors, timeouts, lifetime or pool limits
+	Discarded int64
+}
+
+// poolConn is a connection with pool metadata
+type poolConn struct {
+	net.Conn
+	createdAt time.Time
+	idleSince time.Time
+}
+
+// connPool is a bounded pool of TCP connections to consul
+type connPool struct {
+	dial        func(ctx context.Context) (net.Conn, error)
+	maxIdle     int
+	maxOpen     int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	mx     sync.Mutex
+	idle   []*poolConn
+	open   int
+	closed bool
+	// released is closed and replaced, when a connection is returned or closed
+	released chan struct{}
+
+	dialed    int64
+	reused    int64
+	discarded int64
+}
+
+func newConnPool(dial func(ctx context.Context) (net.Conn, error)) *connPool {
+	return &connPool{
+		dial:     dial,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire returns idle connection or dials new one. If max open connections are reached,
+// it waits for released connection or the context cancellation
+func (p *connPool) acquire(ctx context.Context) (*poolConn, error) {
+	for {
+		p.mx.Lock()
+		if p.closed {
+			p.mx.Unlock()
+			return nil, errPoolClosed
+		}
+
+		p.sweepLocked(time.Now())
+
+		for len(p.idle) > 0 {
+			c := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+
+			if p.expired(c, time.Now()) || !alive(c) {
+				p.discardLocked(c)
+				continue
+			}
+
+			p.reused++
+			p.mx.Unlock()
+			return c, nil
+		}
+
+		if p.maxOpen <= 0 || p.open < p.maxOpen {
+			p.open++
+			p.mx.Unlock()
+
+			conn, err := p.dial(ctx)
+			if err != nil {
+				p.mx.Lock()
+				p.open--
+				p.notifyLocked()
+				p.mx.Unlock()
+				return nil, err
+			}
+
+			p.mx.Lock()
+			p.dialed++
+			p.mx.Unlock()
+
+			return &poolConn{Conn: conn, createdAt: time.Now()}, nil
+		}
+
+		released := p.released
+		p.mx.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release returns the connection to the pool or closes it, if the pool is full or closed
+func (p *connPool) release(c *poolConn) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	now := time.Now()
+	p.sweepLocked(now)
+
+	if p.closed || (p.maxIdle > 0 && len(p.idle) >= p.maxIdle) || p.expired(c, now) {
+		p.discardLocked(c)
+		return
+	}
+
+	c.idleSince = now
+	p.idle = append(p.idle, c)
+	p.notifyLocked()
+}
+
+// discard closes the connection, which must not be reused
+func (p *connPool) discard(c *poolConn) error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.discardLocked(c)
+}
+
+// close closes idle connections, connections in use are closed on release
+func (p *connPool) close() error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var errs []error
+	for _, c := range p.idle {
+		if err := p.discardLocked(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p.idle = nil
+
+	return joinErrors(errs)
+}
+
+func (p *connPool) stats() PoolStats {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return PoolStats{
+		Open:      p.open,
+		Idle:      len(p.idle),
+		Dialed:    p.dialed,
+		Reused:    p.reused,
+		Discarded: p.discarded,
+	}
+}
+
+// sweepLocked closes expired idle connections. The connection on the top of the idle stack is reused first,
+// so connections below it are expired only by the sweep
+func (p *connPool) sweepLocked(now time.Time) {
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if p.expired(c, now) {
+			p.discardLocked(c)
+			continue
+		}
+		idle = append(idle, c)
+	}
+	for i := len(idle); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = idle
+}
+
+func (p *connPool) discardLocked(c *poolConn) error {
+	p.open--
+	p.discarded++
+	p.notifyLocked()
+
+	return c.Close()
+}
+
+func (p *connPool) notifyLocked() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+func (p *connPool) expired(c *poolConn, now time.Time) bool {
+	if p.maxLifetime > 0 && now.Sub(c.createdAt) > p.maxLifetime {
+		return true
+	}
+	if p.idleTimeout > 0 && !c.idleSince.IsZero() && now.Sub(c.idleSince) > p.idleTimeout {
+		return true
+	}
+	return false
+}
+
+// aliveProbeTimeout is the read deadline of the liveness check for connections without raw access to the socket
+const aliveProbeTimeout = time.Millisecond
+
+// aliveByDeadline checks the connection with a short read. The deadline must be in the future,
+// otherwise the read returns the deadline error without reading the connection
+func aliveByDeadline(c *poolConn) bool {
+	if err := c.SetReadDeadline(time.Now().Add(aliveProbeTimeout)); err != nil {
+		return false
+	}
+
+	var b [1]byte
+	_, err := c.Read(b[:])
+
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
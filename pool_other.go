@@ -0,0 +1,8 @@
+//go:build !unix
+
+package go_consul_dns
+
+// alive checks, that idle connection is not closed by the server and has no unexpected data
+func alive(c *poolConn) bool {
+	return aliveByDeadline(c)
+}
@@ -0,0 +1,316 @@
+package go_consul_dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials in-memory connections and keeps server sides for tests
+type pipeDialer struct {
+	mx      sync.Mutex
+	servers []net.Conn
+}
+
+func (d *pipeDialer) dial(_ context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	d.mx.Lock()
+	d.servers = append(d.servers, server)
+	d.mx.Unlock()
+	return client, nil
+}
+
+func newTestPool(t *testing.T) (*connPool, *pipeDialer) {
+	t.Helper()
+
+	d := &pipeDialer{}
+	p := newConnPool(d.dial)
+
+	t.Cleanup(func() {
+		_ = p.close()
+		d.mx.Lock()
+		for _, c := range d.servers {
+			_ = c.Close()
+		}
+		d.mx.Unlock()
+	})
+
+	return p, d
+}
+
+func TestConnPool_Reuse(t *testing.T) {
+	p, _ := newTestPool(t)
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	p.release(c1)
+
+	c2, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c1 != c2 {
+		t.Fatalf("expect reused connection")
+	}
+
+	expect := PoolStats{Open: 1, Idle: 0, Dialed: 1, Reused: 1}
+	if s := p.stats(); s != expect {
+		t.Fatalf("unexpected stats %+v, expect %+v", s, expect)
+	}
+}
+
+func TestConnPool_MaxIdle(t *testing.T) {
+	p, _ := newTestPool(t)
+	p.maxIdle = 1
+
+	var conns []*poolConn
+	for i := 0; i < 3; i++ {
+		c, err := p.acquire(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.release(c)
+	}
+
+	expect := PoolStats{Open: 1, Idle: 1, Dialed: 3, Discarded: 2}
+	if s := p.stats(); s != expect {
+		t.Fatalf("unexpected stats %+v, expect %+v", s, expect)
+	}
+}
+
+func TestConnPool_MaxOpen(t *testing.T) {
+	p, _ := newTestPool(t)
+	p.maxOpen = 1
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	_, err = p.acquire(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v, expect %v", err, context.DeadlineExceeded)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		p.release(c1)
+	}()
+
+	c2, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c1 != c2 {
+		t.Fatalf("expect released connection")
+	}
+	if s := p.stats(); s.Dialed != 1 || s.Open != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestConnPool_IdleTimeout(t *testing.T) {
+	p, _ := newTestPool(t)
+	p.idleTimeout = time.Millisecond * 10
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	p.release(c1)
+
+	time.Sleep(time.Millisecond * 30)
+
+	c2, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c1 == c2 {
+		t.Fatalf("expect new connection")
+	}
+
+	expect := PoolStats{Open: 1, Idle: 0, Dialed: 2, Discarded: 1}
+	if s := p.stats(); s != expect {
+		t.Fatalf("unexpected stats %+v, expect %+v", s, expect)
+	}
+}
+
+func TestConnPool_IdleTimeoutSweep(t *testing.T) {
+	p, _ := newTestPool(t)
+	p.idleTimeout = time.Millisecond * 30
+
+	var conns []*poolConn
+	for i := 0; i < 3; i++ {
+		c, err := p.acquire(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.release(c)
+	}
+
+	// the connection on the top of the idle stack is used sequentially, connections below it are expired
+	deadline := time.Now().Add(time.Millisecond * 100)
+	for time.Now().Before(deadline) {
+		c, err := p.acquire(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		p.release(c)
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	expect := PoolStats{Open: 1, Idle: 1, Dialed: 3, Discarded: 2}
+	if s := p.stats(); s.Open != expect.Open || s.Idle != expect.Idle || s.Dialed != expect.Dialed || s.Discarded != expect.Discarded {
+		t.Fatalf("unexpected stats %+v, expect %+v", s, expect)
+	}
+}
+
+func TestConnPool_MaxLifetime(t *testing.T) {
+	p, _ := newTestPool(t)
+	p.maxLifetime = time.Millisecond * 10
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	p.release(c1)
+
+	expect := PoolStats{Open: 0, Idle: 0, Dialed: 1, Discarded: 1}
+	if s := p.stats(); s != expect {
+		t.Fatalf("unexpected stats %+v, expect %+v", s, expect)
+	}
+}
+
+func TestConnPool_Liveness(t *testing.T) {
+	p, d := newTestPool(t)
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	p.release(c1)
+
+	// server closes the idle connection
+	d.mx.Lock()
+	_ = d.servers[0].Close()
+	d.mx.Unlock()
+
+	c2, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c1 == c2 {
+		t.Fatalf("expect new connection")
+	}
+	if s := p.stats(); s.Dialed != 2 || s.Discarded != 1 || s.Reused != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestConnPool_Close(t *testing.T) {
+	p, _ := newTestPool(t)
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c2, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	p.release(c1)
+
+	if err = p.close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// connection in use is closed on release
+	p.release(c2)
+
+	expect := PoolStats{Open: 0, Idle: 0, Dialed: 2, Discarded: 2}
+	if s := p.stats(); s != expect {
+		t.Fatalf("unexpected stats %+v, expect %+v", s, expect)
+	}
+
+	if _, err = p.acquire(context.Background()); !errors.Is(err, errPoolClosed) {
+		t.Fatalf("unexpected error %v, expect %v", err, errPoolClosed)
+	}
+}
+
+func TestConnPool_LivenessTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listen address, %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, errAccept := ln.Accept()
+			if errAccept != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	p := newConnPool(func(ctx context.Context) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "tcp", ln.Addr().String())
+	})
+	defer p.close()
+
+	c1, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	server := <-accepted
+	p.release(c1)
+
+	// open idle connection is reused
+	c2, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c1 != c2 {
+		t.Fatalf("expect reused connection")
+	}
+	p.release(c2)
+
+	// server writes unexpected data and closes the idle connection
+	_, _ = server.Write([]byte{1})
+	_ = server.Close()
+	time.Sleep(time.Millisecond * 50)
+
+	c3, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c3 == c1 {
+		t.Fatalf("expect new connection")
+	}
+	defer func() {
+		_ = (<-accepted).Close()
+	}()
+
+	if s := p.stats(); s.Dialed != 2 || s.Reused != 1 || s.Discarded != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package go_consul_dns
+
+import (
+	"errors"
+	"syscall"
+)
+
+// alive checks, that idle connection is not closed by the server and has no unexpected data.
+// The socket is read without blocking, so the check does not delay the request
+func alive(c *poolConn) bool {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return aliveByDeadline(c)
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var isAlive bool
+	errRead := rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		_, errSys := syscall.Read(int(fd), b[:])
+		// no data and the connection is open, any read bytes or EOF mean the connection can not be reused
+		isAlive = errors.Is(errSys, syscall.EAGAIN) || errors.Is(errSys, syscall.EWOULDBLOCK)
+		return true
+	})
+
+	return errRead == nil && isAlive
+}
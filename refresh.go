@@ -0,0 +1,116 @@
+package go_consul_dns
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// autoUpdateEnabled returns true, if the background refresh goroutine is started
+func (r *ConsulResolver) autoUpdateEnabled() bool {
+	return r.autoUpdateInterval > 0 || r.ttlRefresh
+}
+
+// startAutoUpdate starts background refresh goroutine, it is stopped by Close
+func (r *ConsulResolver) startAutoUpdate() {
+	r.wg.Add(1)
+	go r.autoUpdate()
+}
+
+// autoUpdate calls Update immediately and then every interval or TTL plus random jitter.
+// After failed updates the delay is extended by the backoff, if it is defined
+func (r *ConsulResolver) autoUpdate() {
+	defer r.wg.Done()
+
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	var failures int
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		errUpdate := r.UpdateContext(r.ctx)
+		if errUpdate != nil && r.ctx.Err() == nil {
+			r.logger.Printf("error auto update, %v", errUpdate)
+		}
+
+		if errUpdate != nil && r.backoff != nil {
+			failures++
+			t.Reset(r.retryDelay(failures))
+			continue
+		}
+		failures = 0
+
+		t.Reset(r.nextAutoUpdate())
+	}
+}
+
+// retryDelay returns delay before the background update after failures. The backoff only extends
+// the regular delay, so failed updates are never retried more often than successful ones
+func (r *ConsulResolver) retryDelay(failures int) time.Duration {
+	d := r.nextAutoUpdate()
+	if b := r.backoff.Delay(failures); b > d {
+		d = b
+	}
+	return d
+}
+
+// nextAutoUpdate returns delay before the next background update
+func (r *ConsulResolver) nextAutoUpdate() time.Duration {
+	d := r.autoUpdateInterval
+	if r.ttlRefresh {
+		d = r.ttlInterval()
+	}
+	if r.autoUpdateJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(r.autoUpdateJitter)))
+	}
+	return d
+}
+
+// ttlInterval returns the min TTL of the last response clamped between ttlRefreshMin and ttlRefreshMax.
+// Zero min interval is replaced with defaultTTLRefreshMin, because consul responds with zero TTL by default
+func (r *ConsulResolver) ttlInterval() time.Duration {
+	minInterval := r.ttlRefreshMin
+	if minInterval <= 0 {
+		minInterval = defaultTTLRefreshMin
+	}
+
+	d := time.Duration(atomic.LoadInt64(&r.minTTL))
+	if d < minInterval {
+		d = minInterval
+	}
+	if r.ttlRefreshMax > 0 && d > r.ttlRefreshMax {
+		d = r.ttlRefreshMax
+	}
+	return d
+}
+
+// storeMinTTL stores the min TTL of SRV records and target addresses from the response
+func (r *ConsulResolver) storeMinTTL(m *dnsmessage.Message) {
+	var minTTL uint32
+	var found bool
+
+	records := append(append([]dnsmessage.Resource{}, m.Answers...), m.Additionals...)
+	for _, record := range records {
+		switch record.Body.(type) {
+		case *dnsmessage.SRVResource, *dnsmessage.AResource, *dnsmessage.AAAAResource:
+		default:
+			continue
+		}
+		if !found || record.Header.TTL < minTTL {
+			minTTL = record.Header.TTL
+			found = true
+		}
+	}
+
+	if found {
+		atomic.StoreInt64(&r.minTTL, int64(time.Duration(minTTL)*time.Second))
+	}
+}
@@ -1,7 +1,8 @@
 package go_consul_dns
 
 import (
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -22,11 +23,16 @@ type nopLogger struct{}
 func (l *nopLogger) Printf(_ string, _ ...any) {}
 
 var (
-	defaultTimeout         = time.Second * 10
-	defaultConsulAddress   = "127.0.0.1:8600"
-	defaultDatacenter      = "dc1"
-	defaultDomain          = "consul"
-	defaultRequestAttempts = 16
+	defaultTimeout           = time.Second * 10
+	defaultConsulAddress     = "127.0.0.1:8600"
+	defaultDatacenter        = "dc1"
+	defaultDomain            = "consul"
+	defaultRequestAttempts   = 16
+	defaultMaxMessageSize    = 65535
+	defaultMaxIdleConns      = 4
+	defaultConnIdleTimeout   = time.Second * 5
+	defaultLookupConcurrency = 4
+	defaultTTLRefreshMin     = time.Second
 )
 
 type Resolver interface {
@@ -37,40 +43,117 @@ type Resolver interface {
 	Close() error
 }
 
+var _ Resolver = (*ConsulResolver)(nil)
+
 type ConsulResolver struct {
-	address           string
-	datacenter        string
-	domain            string
-	timeout           time.Duration
-	getAddressFromSRV bool
-	requestAttempts   int
-	logger            Logger
-
-	mx       *sync.RWMutex
-	counter  int64
-	data     []string
-	inUpdate int64
+	address             string
+	datacenter          string
+	domain              string
+	timeout             time.Duration
+	getAddressFromSRV   bool
+	addressFamily       AddressFamily
+	externalResolver    *net.Resolver
+	keepOnNoSuchService bool
+	lookupConcurrency   int
+	dropUnresolved      bool
+	requestAttempts     int
+	backoff             Backoff
+	maxMessageSize      int
+	logger              Logger
 
-	connsPool *sync.Pool
-	dnsName   dnsmessage.Name
+	counter  int64
+	snapshot atomic.Pointer[Snapshot]
+
+	watchMx  sync.Mutex
+	watchers map[chan Snapshot]struct{}
+	onChange func(added, removed []Endpoint)
+	// changes are collected by the update in progress
+	changes []endpointsChange
+
+	callMx sync.Mutex
+	call   *updateCall
+	closed bool
+
+	lookupFallbacks    int64
+	truncatedFallbacks int64
+	rejectedUpdates    int64
+
+	guardMaxRemovedPercent int
+	guardMinEndpoints      int
+	guardConfirmations     int
+	guardRejects           int
+
+	dampRemoveAfter int
+	dampRemoveDelay time.Duration
+	dampAddAfter    int
+	flaps           map[string]*flapState
+
+	maxStale time.Duration
+	waitCtx  context.Context
+	waitMin  int
+	result   atomic.Pointer[updateResult]
+
+	autoUpdateInterval time.Duration
+	autoUpdateJitter   time.Duration
+	ttlRefresh         bool
+	ttlRefreshMin      time.Duration
+	ttlRefreshMax      time.Duration
+	minTTL             int64
+	ctx                context.Context
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup
+
+	pool            *connPool
+	mux             *muxTransport
+	transport       *Transport
+	udpSize         int
+	pipelineConns   int
+	maxIdleConns    int
+	maxOpenConns    int
+	connIdleTimeout time.Duration
+	connMaxLifetime time.Duration
+	dnsName         dnsmessage.Name
 }
 
 func New(service string, opts ...Option) (*ConsulResolver, error) {
 	r := &ConsulResolver{
-		address:         defaultConsulAddress,
-		datacenter:      defaultDatacenter,
-		domain:          defaultDomain,
-		timeout:         defaultTimeout,
-		requestAttempts: defaultRequestAttempts,
-		mx:              &sync.RWMutex{},
-		connsPool:       &sync.Pool{},
-		logger:          &nopLogger{},
+		address:           defaultConsulAddress,
+		datacenter:        defaultDatacenter,
+		domain:            defaultDomain,
+		timeout:           defaultTimeout,
+		requestAttempts:   defaultRequestAttempts,
+		lookupConcurrency: defaultLookupConcurrency,
+		maxMessageSize:    defaultMaxMessageSize,
+		maxIdleConns:      defaultMaxIdleConns,
+		connIdleTimeout:   defaultConnIdleTimeout,
+		logger:            &nopLogger{},
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 
 	for _, o := range opts {
 		o(r)
 	}
 
+	r.pool = newConnPool(r.dial)
+	r.pool.maxIdle = r.maxIdleConns
+	r.pool.maxOpen = r.maxOpenConns
+	r.pool.idleTimeout = r.connIdleTimeout
+	r.pool.maxLifetime = r.connMaxLifetime
+
+	if r.udpSize > 0 && r.udpSize < minUDPSize {
+		r.udpSize = minUDPSize
+	}
+	if r.udpSize > r.maxMessageSize {
+		r.udpSize = r.maxMessageSize
+	}
+
+	if r.transport != nil {
+		r.address = r.transport.address
+		r.mux = r.transport.mux
+	} else if r.pipelineConns > 0 {
+		r.mux = newMuxTransport(r.dial, r.pipelineConns, r.maxMessageSize, r.logger)
+	}
+
 	var err error
 
 	r.dnsName, err = dnsmessage.NewName(service + ".service." + r.datacenter + "." + r.domain + ".")
@@ -78,223 +161,502 @@ func New(service string, opts ...Option) (*ConsulResolver, error) {
 		return nil, fmt.Errorf("error parse service name, %w", err)
 	}
 
+	if r.autoUpdateEnabled() {
+		r.startAutoUpdate()
+	}
+
+	if r.waitCtx != nil {
+		errWait := r.WaitForEndpoints(r.waitCtx, r.waitMin)
+		if errWait != nil {
+			_ = r.Close()
+			return nil, errWait
+		}
+		r.waitCtx = nil
+	}
+
 	return r, nil
 }
 
+// All returns all cached addresses. The returned slice must not be modified
 func (r *ConsulResolver) All() []string {
-	r.mx.RLock()
-	defer r.mx.RUnlock()
+	return r.load().Addresses
+}
 
-	return r.data
+// Endpoints returns all cached endpoints with SRV record details. The returned slice must not be modified
+func (r *ConsulResolver) Endpoints() []Endpoint {
+	return r.load().Endpoints
 }
 
 func (r *ConsulResolver) Random() string {
-	r.mx.RLock()
-	defer r.mx.RUnlock()
+	data := r.load().Addresses
 
-	if len(r.data) == 0 {
+	if len(data) == 0 {
 		return ""
 	}
 
-	return r.data[rand.Intn(len(r.data))]
+	return data[rand.Intn(len(data))]
 }
 
 func (r *ConsulResolver) Next() string {
-	r.mx.RLock()
-	defer r.mx.RUnlock()
+	data := r.load().Addresses
 
-	if len(r.data) == 0 {
+	if len(data) == 0 {
 		return ""
 	}
 
 	n := atomic.AddInt64(&r.counter, 1)
-	return r.data[int(n-1)%len(r.data)]
+	return data[int(n-1)%len(data)]
+}
+
+// Close stops background updates, interrupts the update in progress, waits for it and closes connections.
+// Later updates return ErrClosed. Repeated calls return nil
+func (r *ConsulResolver) Close() error {
+	r.callMx.Lock()
+	if r.closed {
+		r.callMx.Unlock()
+		return nil
+	}
+	r.closed = true
+	c := r.call
+	r.callMx.Unlock()
+
+	r.cancel()
+	if c != nil {
+		<-c.done
+	}
+	r.wg.Wait()
+
+	var errs []error
+
+	if errClose := r.pool.close(); errClose != nil {
+		errs = append(errs, fmt.Errorf("error close connections, %w", errClose))
+	}
+	// the shared transport is closed by the owner
+	if r.mux != nil && r.transport == nil {
+		if errClose := r.mux.close(); errClose != nil {
+			errs = append(errs, fmt.Errorf("error close pipelined connections, %w", errClose))
+		}
+	}
+
+	return joinErrors(errs)
 }
 
-func (r *ConsulResolver) Close() {
+// Update calls UpdateContext with background context
+func (r *ConsulResolver) Update() error {
+	return r.UpdateContext(context.Background())
+}
+
+// UpdateContext receives SRV records and stores service addresses to the cache.
+// The context deadline limits dial, write and read operations and the retry loop.
+// If the update is already in progress, UpdateContext waits for it and returns its result
+func (r *ConsulResolver) UpdateContext(ctx context.Context) error {
 	for {
-		c := r.connsPool.Get()
-		if c == nil {
-			return
+		r.callMx.Lock()
+		if r.closed {
+			r.callMx.Unlock()
+			return ErrClosed
 		}
-		errClose := c.(net.Conn).Close()
-		if errClose != nil {
-			r.logger.Printf("error close connection, %v", errClose)
+		if c := r.call; c != nil {
+			r.callMx.Unlock()
+			select {
+			case <-c.done:
+				// the update is interrupted by the context of another caller, start the update again
+				if isContextError(c.err) && ctx.Err() == nil {
+					continue
+				}
+				return c.err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
+		c := r.startCall()
+		r.callMx.Unlock()
+
+		return r.finishCall(c, r.runUpdate(ctx))
 	}
 }
 
-func (r *ConsulResolver) Update() error {
-	if !atomic.CompareAndSwapInt64(&r.inUpdate, 0, 1) {
-		return nil
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// TryUpdate starts the update only if it is not in progress. It does not wait for the update in progress
+// and returns false in this case
+func (r *ConsulResolver) TryUpdate(ctx context.Context) (bool, error) {
+	r.callMx.Lock()
+	if r.closed {
+		r.callMx.Unlock()
+		return false, ErrClosed
 	}
-	defer atomic.StoreInt64(&r.inUpdate, 0)
+	if r.call != nil {
+		r.callMx.Unlock()
+		return false, nil
+	}
+	c := r.startCall()
+	r.callMx.Unlock()
+
+	return true, r.finishCall(c, r.runUpdate(ctx))
+}
+
+// updateCall is the update in progress, concurrent UpdateContext calls wait for its result
+type updateCall struct {
+	done chan struct{}
+	err  error
+}
+
+// startCall registers new update call, callMx must be locked
+func (r *ConsulResolver) startCall() *updateCall {
+	c := &updateCall{done: make(chan struct{})}
+	r.call = c
+	return c
+}
+
+func (r *ConsulResolver) finishCall(c *updateCall, err error) error {
+	c.err = err
+	r.recordResult(err)
+
+	changes := r.changes
+	r.changes = nil
+
+	r.callMx.Lock()
+	r.call = nil
+	r.callMx.Unlock()
+
+	close(c.done)
+
+	// the callback is called after the update is finished, so it does not block waiting callers
+	for _, change := range changes {
+		r.onChange(change.added, change.removed)
+	}
+
+	return err
+}
+
+// runUpdate runs the update on the context, which is also cancelled by Close,
+// so Close interrupts the update in progress instead of waiting for its timeouts
+func (r *ConsulResolver) runUpdate(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
 
-	srvMessage, errSrv := r.consulRequest(r.dnsName, dnsmessage.TypeSRV)
+	err := r.update(ctx)
+	if err != nil && r.ctx.Err() != nil {
+		return ErrClosed
+	}
+	return err
+}
+
+func (r *ConsulResolver) update(ctx context.Context) error {
+	srvMessage, errSrv := r.consulRequest(ctx, r.dnsName, dnsmessage.TypeSRV)
 	if errSrv != nil {
+		if errors.Is(errSrv, ErrNoSuchService) && !r.keepOnNoSuchService {
+			// consul responds with NXDOMAIN, when the service has no healthy instances, it is damped like missing endpoints
+			_ = r.apply(nil)
+		}
 		return fmt.Errorf("error get SRV records, %w", errSrv)
 	}
 
-	var result []string
+	r.storeMinTTL(srvMessage)
+
+	var endpoints []Endpoint
 
-	var srvRecords []*dnsmessage.SRVResource
 	hosts := map[string]dnsmessage.Name{}
 
 	for _, answer := range srvMessage.Answers {
 		srv, ok := answer.Body.(*dnsmessage.SRVResource)
 		if !ok {
-			return fmt.Errorf("expect *dnsmessage.SRVResource, got %T", answer.Body)
+			if _, isCNAME := answer.Body.(*dnsmessage.CNAMEResource); !isCNAME {
+				r.logger.Printf("skip unexpected record %T for %s", answer.Body, r.dnsName.String())
+			}
+			continue
+		}
+
+		endpoint := Endpoint{
+			Port:     srv.Port,
+			Target:   srv.Target.String(),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+			TTL:      time.Duration(answer.Header.TTL) * time.Second,
 		}
 
 		if r.getAddressFromSRV {
-			// for SRV addresses like '7f000001.addr.dc1.consul.'
-			hexIP, errHexDecode := hex.DecodeString(string(srv.Target.Data[:8]))
-			if errHexDecode != nil {
-				return fmt.Errorf("error decode hex address, %w", errHexDecode)
+			// targets like node names or external hosts are not addr-encoded, they are resolved with A/AAAA requests
+			if ip, ok := parseAddrTarget(endpoint.Target); ok {
+				endpoint.IP = ip
+				endpoint.Address = net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port)))
+				endpoints = append(endpoints, endpoint)
+				continue
 			}
-
-			result = append(result, fmt.Sprintf("%d.%d.%d.%d:%d", hexIP[0], hexIP[1], hexIP[2], hexIP[3], srv.Port))
-			continue
 		}
 
-		hosts[srv.Target.String()] = srv.Target
-		srvRecords = append(srvRecords, srv)
+		hosts[endpoint.Target] = srv.Target
+		endpoints = append(endpoints, endpoint)
 	}
 
-	if !r.getAddressFromSRV {
-		addresses := map[string]string{}
+	if len(hosts) > 0 {
+		addresses := map[string]*hostAddresses{}
+		for k := range hosts {
+			addresses[k] = &hostAddresses{}
+		}
 
+		// consul returns addresses of SRV targets in the additional section
+		additionals := newRecordSet(srvMessage.Additionals)
 		for k, v := range hosts {
-			aMessage, errA := r.consulRequest(v, dnsmessage.TypeA)
-			if errA != nil {
-				return fmt.Errorf("error get A records, %w", errA)
-			}
+			additionals.resolve(v, addresses[k])
+		}
 
-			for _, answer := range aMessage.Answers {
-				mm, ok := answer.Body.(*dnsmessage.AResource)
-				if !ok {
-					return fmt.Errorf("expect *dnsmessage.AResource, got %T", answer.Body)
-				}
-				addresses[k] = fmt.Sprintf("%d.%d.%d.%d", mm.A[0], mm.A[1], mm.A[2], mm.A[3])
+		missing := map[string]dnsmessage.Name{}
+		for k, v := range hosts {
+			if !addresses[k].missing(r.addressFamily) {
+				continue
 			}
+			atomic.AddInt64(&r.lookupFallbacks, 1)
+			missing[k] = v
+		}
+
+		errLookup := r.lookupHosts(ctx, missing, addresses)
+		if errLookup != nil {
+			return errLookup
 		}
 
-		for _, srv := range srvRecords {
-			ip, ok := addresses[srv.Target.String()]
-			if !ok {
-				return fmt.Errorf("unexpected not found info about host %s", srv.Target.String())
+		resolved := make([]Endpoint, 0, len(endpoints))
+
+		for _, endpoint := range endpoints {
+			if endpoint.IP != nil {
+				resolved = append(resolved, endpoint)
+				continue
+			}
+
+			ips := addresses[endpoint.Target].ips(r.addressFamily)
+			if len(ips) == 0 {
+				if r.dropUnresolved {
+					r.logger.Printf("drop unresolved target %s", endpoint.Target)
+					continue
+				}
+				return fmt.Errorf("unexpected not found info about host %s", endpoint.Target)
+			}
+			for _, ip := range ips {
+				endpoint.IP = ip
+				endpoint.Address = net.JoinHostPort(ip.String(), strconv.Itoa(int(endpoint.Port)))
+				resolved = append(resolved, endpoint)
 			}
-			result = append(result, ip+":"+strconv.Itoa(int(srv.Port)))
 		}
-	}
 
-	r.mx.Lock()
-	r.data = r.data[:0]
-	r.data = append(r.data, result...)
-	r.mx.Unlock()
+		endpoints = resolved
+	}
 
-	return nil
+	return r.apply(endpoints)
 }
 
-func (r *ConsulResolver) releaseConn(conn net.Conn) {
-	r.connsPool.Put(conn)
+func (r *ConsulResolver) releaseConn(conn *poolConn) {
+	r.pool.release(conn)
 }
 
-func (r *ConsulResolver) acquireConn() (net.Conn, error) {
-	c := r.connsPool.Get()
-	if c != nil {
-		return c.(net.Conn), nil
+func (r *ConsulResolver) closeConn(conn *poolConn) {
+	errClose := r.pool.discard(conn)
+	if errClose != nil {
+		r.logger.Printf("error close connection, %v", errClose)
 	}
+}
 
+func (r *ConsulResolver) acquireConn(ctx context.Context) (*poolConn, error) {
+	return r.pool.acquire(ctx)
+}
+
+func (r *ConsulResolver) dial(ctx context.Context) (net.Conn, error) {
 	d := net.Dialer{Timeout: r.timeout}
-	cc, err := d.Dial("tcp", r.address)
-	if err != nil {
-		return nil, err
+	return d.DialContext(ctx, "tcp", r.address)
+}
+
+// contextError returns the context error. The deadline error is returned, when the deadline is passed,
+// but the context is not done yet, so failed operations limited by the deadline are reported as the context error
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// interruptOnDone interrupts blocked operations on the connection, when the context is done.
+// The returned function stops watching the context
+func interruptOnDone(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
 	}
-	return cc, nil
 }
 
-func (r *ConsulResolver) consulRequest(name dnsmessage.Name, t dnsmessage.Type) (*dnsmessage.Message, error) {
+// deadline returns the operation deadline, which is not later than the context deadline
+func (r *ConsulResolver) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(r.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+func (r *ConsulResolver) consulRequest(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type) (*dnsmessage.Message, error) {
 	q := dnsmessage.Question{
 		Name:  name,
 		Type:  t,
 		Class: dnsmessage.ClassINET,
 	}
-	b := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{})
-	if err := b.StartQuestions(); err != nil {
-		return nil, fmt.Errorf("error build message, start questions, %w", err)
-	}
-	if err := b.Question(q); err != nil {
-		return nil, fmt.Errorf("error build message, add question, %w", err)
-	}
-	req, err := b.Finish()
-	if err != nil {
-		return nil, fmt.Errorf("error build message, finish, %w", err)
-	}
 
-	l := len(req) - 2
-	req[0] = byte(l >> 8)
-	req[1] = byte(l)
+	var lastErr error
 
 	for i := 0; i < r.requestAttempts; i++ {
-		conn, errGetConnection := r.acquireConn()
-		if errGetConnection != nil {
-			return nil, fmt.Errorf("error get connection, %w", errGetConnection)
-		}
-
-		errWriteDeadline := conn.SetWriteDeadline(time.Now().Add(r.timeout))
-		if errWriteDeadline != nil {
-			r.logger.Printf("error set write deadline, %v", errWriteDeadline)
-			errClose := conn.Close()
-			if errClose != nil {
-				r.logger.Printf("error close connection, %v", errClose)
+		if i > 0 && r.backoff != nil {
+			if errSleep := sleep(ctx, r.backoff.Delay(i)); errSleep != nil {
+				return nil, errSleep
 			}
-			continue
 		}
-		_, errWrite := conn.Write(req)
-		if errWrite != nil {
-			r.logger.Printf("error write to connection, %v", errWrite)
-			errClose := conn.Close()
-			if errClose != nil {
-				r.logger.Printf("error close connection, %v", errClose)
-			}
-			continue
+
+		if errCtx := contextError(ctx); errCtx != nil {
+			return nil, errCtx
 		}
 
-		res := make([]byte, 0)
-		buf := make([]byte, 1024)
-		for {
-			errReadDeadline := conn.SetDeadline(time.Now().Add(r.timeout))
-			if errReadDeadline != nil {
-				r.logger.Printf("error set read deadline, %v", errReadDeadline)
-				errClose := conn.Close()
-				if errClose != nil {
-					r.logger.Printf("error close connection, %v", errClose)
-				}
-				break
+		m, retry, errAttempt := r.transportAttempt(ctx, q)
+
+		if errAttempt != nil {
+			if errCtx := contextError(ctx); errCtx != nil {
+				return nil, errCtx
 			}
-			n, errRead := conn.Read(buf)
-			if errRead != nil {
-				r.logger.Printf("error read from connection, %v", errRead)
-				errClose := conn.Close()
-				if errClose != nil {
-					r.logger.Printf("error close connection, %v", errClose)
-				}
-				break
+			if !retry {
+				return nil, errAttempt
 			}
+			lastErr = errAttempt
+			continue
+		}
 
-			res = append(res, buf[:n]...)
-			if n < len(buf) {
-				m := &dnsmessage.Message{}
-				errUnpack := m.Unpack(res[2:])
-				if errUnpack != nil {
-					return nil, fmt.Errorf("error unpack reponse, %w", errUnpack)
-				}
-				r.releaseConn(conn)
-				return m, nil
-			}
+		if m.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, &RCodeError{Name: name.String(), RCode: m.Header.RCode}
 		}
+
+		return m, nil
+	}
+
+	return nil, &AttemptsError{Attempts: r.requestAttempts, Err: lastErr}
+}
+
+// attempt sends the query over the connection from the pool. It returns true, if the failed query may be retried
+func (r *ConsulResolver) attempt(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, bool, error) {
+	id := uint16(rand.Intn(1 << 16))
+
+	req, errBuild := buildQuery(id, q)
+	if errBuild != nil {
+		return nil, false, errBuild
+	}
+
+	conn, errGetConnection := r.acquireConn(ctx)
+	if errGetConnection != nil {
+		return nil, false, fmt.Errorf("error get connection, %w", wrapTimeout(errGetConnection))
+	}
+
+	res, errExchange := r.exchange(ctx, conn, req)
+	if errExchange != nil {
+		r.logger.Printf("error exchange, %v", errExchange)
+		r.closeConn(conn)
+		return nil, !errors.Is(errExchange, ErrFrameTooLarge), errExchange
+	}
+
+	m := &dnsmessage.Message{}
+	errUnpack := m.Unpack(res)
+	if errUnpack != nil {
+		r.closeConn(conn)
+		return nil, false, fmt.Errorf("error unpack reponse, %w", errUnpack)
+	}
+
+	// the connection may contain late responses for previous requests, do not return it to the pool
+	errCheck := checkResponse(m, id, q)
+	if errCheck != nil {
+		r.logger.Printf("error check response, %v", errCheck)
+		r.closeConn(conn)
+		return nil, true, errCheck
+	}
+
+	r.releaseConn(conn)
+
+	return m, false, nil
+}
+
+// muxAttempt sends the query over the shared pipelined connection. It returns true, if the failed query may be retried
+func (r *ConsulResolver) muxAttempt(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, bool, error) {
+	res, id, errExchange := r.mux.exchange(ctx, q, r.deadline(ctx))
+	if errExchange != nil {
+		r.logger.Printf("error exchange, %v", errExchange)
+		return nil, !errors.Is(errExchange, ErrFrameTooLarge), errExchange
+	}
+
+	m := &dnsmessage.Message{}
+	errUnpack := m.Unpack(res)
+	if errUnpack != nil {
+		return nil, false, fmt.Errorf("error unpack reponse, %w", errUnpack)
+	}
+
+	// responses are dispatched by ID, so only the question may not match
+	errCheck := checkResponse(m, id, q)
+	if errCheck != nil {
+		r.logger.Printf("error check response, %v", errCheck)
+		return nil, true, errCheck
+	}
+
+	return m, false, nil
+}
+
+// exchange writes length-prefixed request to the connection and reads one length-prefixed response.
+// The read deadline covers the whole response message, not a single read call.
+// Context cancellation interrupts blocked write or read
+func (r *ConsulResolver) exchange(ctx context.Context, conn net.Conn, req []byte) ([]byte, error) {
+	defer interruptOnDone(ctx, conn)()
+
+	errWriteDeadline := conn.SetWriteDeadline(r.deadline(ctx))
+	if errWriteDeadline != nil {
+		return nil, fmt.Errorf("error set write deadline, %w", errWriteDeadline)
+	}
+	_, errWrite := conn.Write(req)
+	if errWrite != nil {
+		return nil, fmt.Errorf("error write to connection, %w", wrapTimeout(errWrite))
+	}
+
+	errReadDeadline := conn.SetReadDeadline(r.deadline(ctx))
+	if errReadDeadline != nil {
+		return nil, fmt.Errorf("error set read deadline, %w", errReadDeadline)
+	}
+	res, errRead := readFrame(conn, r.maxMessageSize)
+	if errRead != nil {
+		return nil, fmt.Errorf("error read from connection, %w", wrapTimeout(errRead))
 	}
 
-	return nil, fmt.Errorf("max attempts reached")
+	// the complete response is returned, even if the context is done after it is read.
+	// The deadline reset by the cancellation is redefined by the next exchange
+	return res, nil
 }
@@ -1,11 +1,19 @@
 package go_consul_dns
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestNew_Error_NoConnection(t *testing.T) {
@@ -39,10 +47,37 @@ func TestTimeout(t *testing.T) {
 		return
 	}
 
-	if !strings.HasSuffix(errUpdate.Error(), "error get SRV records, max attempts reached") {
+	if !strings.HasPrefix(errUpdate.Error(), "error get SRV records, max attempts reached") {
 		t.Errorf("unexpected error message, %v", errUpdate)
 		return
 	}
+
+	if !errors.Is(errUpdate, ErrMaxAttempts) {
+		t.Errorf("unexpected error, %v", errUpdate)
+		return
+	}
+
+	if !errors.Is(errUpdate, ErrTimeout) {
+		t.Errorf("unexpected error, %v", errUpdate)
+		return
+	}
+
+	var attemptsErr *AttemptsError
+	if !errors.As(errUpdate, &attemptsErr) || attemptsErr.Attempts != 1 {
+		t.Errorf("unexpected error, %v", errUpdate)
+		return
+	}
+
+	// the network error is kept in the chain
+	var netErr net.Error
+	if !errors.As(errUpdate, &netErr) || !netErr.Timeout() {
+		t.Errorf("unexpected error, %v", errUpdate)
+		return
+	}
+	if !errors.Is(errUpdate, os.ErrDeadlineExceeded) {
+		t.Errorf("unexpected error, %v", errUpdate)
+		return
+	}
 }
 
 func TestNew_Options(t *testing.T) {
@@ -85,9 +120,7 @@ func TestNew_Options(t *testing.T) {
 }
 
 func TestConsulResolver_Random_Empty(t *testing.T) {
-	r := &ConsulResolver{
-		mx: &sync.RWMutex{},
-	}
+	r := &ConsulResolver{}
 
 	v := r.Random()
 	if v != "" {
@@ -96,9 +129,7 @@ func TestConsulResolver_Random_Empty(t *testing.T) {
 }
 
 func TestConsulResolver_Next_Empty(t *testing.T) {
-	r := &ConsulResolver{
-		mx: &sync.RWMutex{},
-	}
+	r := &ConsulResolver{}
 
 	v := r.Next()
 	if v != "" {
@@ -107,10 +138,8 @@ func TestConsulResolver_Next_Empty(t *testing.T) {
 }
 
 func TestConsulResolver_Random(t *testing.T) {
-	r := &ConsulResolver{
-		mx:   &sync.RWMutex{},
-		data: []string{"one", "two", "three"},
-	}
+	r := &ConsulResolver{}
+	r.store([]Endpoint{{Address: "one"}, {Address: "two"}, {Address: "three"}})
 
 	var v string
 
@@ -141,10 +170,8 @@ func TestConsulResolver_Random(t *testing.T) {
 }
 
 func TestConsulResolver_Next(t *testing.T) {
-	r := &ConsulResolver{
-		mx:   &sync.RWMutex{},
-		data: []string{"one", "two", "three"},
-	}
+	r := &ConsulResolver{}
+	r.store([]Endpoint{{Address: "one"}, {Address: "two"}, {Address: "three"}})
 
 	var v string
 
@@ -171,10 +198,8 @@ func TestConsulResolver_Next(t *testing.T) {
 }
 
 func TestConsulResolver_All(t *testing.T) {
-	r := &ConsulResolver{
-		mx:   &sync.RWMutex{},
-		data: []string{"one", "two", "three"},
-	}
+	r := &ConsulResolver{}
+	r.store([]Endpoint{{Address: "one"}, {Address: "two"}, {Address: "three"}})
 
 	v := r.All()
 	if len(v) != 3 {
@@ -184,3 +209,1735 @@ func TestConsulResolver_All(t *testing.T) {
 		t.Fatal("unexpected output")
 	}
 }
+
+func TestUpdate_SplitResponse(t *testing.T) {
+	s := startTestServer(t, serviceHandler(300, 3))
+	s.write = func(conn net.Conn, b []byte) error {
+		for len(b) > 0 {
+			n := 100
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := conn.Write(b[:n]); err != nil {
+				return err
+			}
+			b = b[n:]
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	all := r.All()
+	if len(all) != 300 {
+		t.Fatalf("unexpected services count %d, expect 300", len(all))
+	}
+	if all[0] != "10.0.0.1:2000" || all[299] != "10.0.0.3:2299" {
+		t.Fatalf("unexpected addresses %s, %s", all[0], all[299])
+	}
+}
+
+func TestUpdate_FrameTooLarge(t *testing.T) {
+	s := startTestServer(t, serviceHandler(300, 3))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithMaxMessageSize(1024))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	err = r.Update()
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestUpdate_ResponseIDMismatch(t *testing.T) {
+	var requests int64
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		// the first response is a late answer for another request
+		if atomic.AddInt64(&requests, 1) == 1 {
+			resp.Header.ID++
+		}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+	// the connection with mismatched response is not reused
+	if conns := atomic.LoadInt64(&s.conns); conns < 2 {
+		t.Fatalf("unexpected connections count %d, expect at least 2", conns)
+	}
+}
+
+func TestUpdate_ResponseQuestionMismatch(t *testing.T) {
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		resp.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("bar.service.dc1.consul."), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithMaxRequestAttempts(2))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err == nil {
+		t.Fatal("unexpected no error")
+	}
+	if conns := atomic.LoadInt64(&s.conns); conns != 2 {
+		t.Fatalf("unexpected connections count %d, expect 2", conns)
+	}
+}
+
+func rcodeHandler(count int, rcode *int64) func(req *dnsmessage.Message) *dnsmessage.Message {
+	handler := serviceHandler(count, 1)
+	return func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		resp.Header.RCode = dnsmessage.RCode(atomic.LoadInt64(rcode))
+		if resp.Header.RCode != dnsmessage.RCodeSuccess {
+			resp.Answers = nil
+		}
+		return resp
+	}
+}
+
+func TestUpdate_RCode(t *testing.T) {
+	var rcode int64
+	s := startTestServer(t, rcodeHandler(3, &rcode))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeServerFailure))
+	err = r.Update()
+	if !errors.Is(err, ErrServerFailure) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeRefused))
+	err = r.Update()
+	if !errors.Is(err, ErrRefused) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	var rcodeErr *RCodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeNameError))
+	err = r.Update()
+	if !errors.Is(err, ErrNoSuchService) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 0 {
+		t.Fatalf("unexpected services count %d, expect 0", len(r.All()))
+	}
+}
+
+func TestUpdate_KeepDataOnNoSuchService(t *testing.T) {
+	var rcode int64
+	s := startTestServer(t, rcodeHandler(3, &rcode))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithKeepDataOnNoSuchService())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeNameError))
+	err = r.Update()
+	if !errors.Is(err, ErrNoSuchService) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+}
+
+func TestUpdate_Endpoints(t *testing.T) {
+	s := startTestServer(t, serviceHandler(4, 2))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	endpoints := r.Endpoints()
+	if len(endpoints) != 4 {
+		t.Fatalf("unexpected endpoints count %d, expect 4", len(endpoints))
+	}
+
+	e := endpoints[3]
+	if e.Address != "10.0.0.2:2003" || !e.IP.Equal(net.IPv4(10, 0, 0, 2)) || e.Port != 2003 {
+		t.Fatalf("unexpected endpoint address %s, %s, %d", e.Address, e.IP, e.Port)
+	}
+	if e.Target != "node1.node.dc1.consul." || e.Node() != "node1" {
+		t.Fatalf("unexpected endpoint target %s, node %s", e.Target, e.Node())
+	}
+	if e.Priority != 1 || e.Weight != 4 || e.TTL != 30*time.Second {
+		t.Fatalf("unexpected endpoint priority %d, weight %d, ttl %s", e.Priority, e.Weight, e.TTL)
+	}
+
+	all := r.All()
+	for i := range endpoints {
+		if all[i] != endpoints[i].Address {
+			t.Fatalf("unexpected address %s, expect %s", all[i], endpoints[i].Address)
+		}
+	}
+}
+
+func TestEndpoint_Node(t *testing.T) {
+	if n := (Endpoint{Target: "7f000001.addr.dc1.consul."}).Node(); n != "" {
+		t.Fatalf("unexpected node %s", n)
+	}
+	if n := (Endpoint{Target: "web-1.node.dc1.consul."}).Node(); n != "web-1" {
+		t.Fatalf("unexpected node %s", n)
+	}
+}
+
+func TestUpdate_Additionals(t *testing.T) {
+	var requests int64
+	handler := withAdditionals(serviceHandler(10, 5), 3)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		if req.Questions[0].Type == dnsmessage.TypeA {
+			atomic.AddInt64(&requests, 1)
+		}
+		return handler(req)
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	all := r.All()
+	if len(all) != 10 {
+		t.Fatalf("unexpected services count %d, expect 10", len(all))
+	}
+	if all[0] != "10.0.0.1:2000" || all[4] != "10.0.0.5:2004" {
+		t.Fatalf("unexpected addresses %s, %s", all[0], all[4])
+	}
+
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Fatalf("unexpected A requests count %d, expect 2", n)
+	}
+	if n := r.Stats().LookupFallbacks; n != 2 {
+		t.Fatalf("unexpected lookup fallbacks %d, expect 2", n)
+	}
+}
+
+func TestUpdate_AddressFamily(t *testing.T) {
+	t.Run("lookup", func(t *testing.T) {
+		testUpdateAddressFamily(t, serviceHandler(4, 2))
+	})
+	// A records in the additional section must not prevent AAAA requests
+	t.Run("additionals", func(t *testing.T) {
+		testUpdateAddressFamily(t, withAdditionals(serviceHandler(4, 2), 2))
+	})
+}
+
+func testUpdateAddressFamily(t *testing.T, handler func(req *dnsmessage.Message) *dnsmessage.Message) {
+	s := startTestServer(t, handler)
+
+	tests := []struct {
+		family AddressFamily
+		expect []string
+	}{
+		{AddressFamilyIPv4, []string{"10.0.0.1:2000", "10.0.0.2:2001", "10.0.0.1:2002", "10.0.0.2:2003"}},
+		{AddressFamilyBoth, []string{"10.0.0.1:2000", "[fd00::1]:2000", "10.0.0.2:2001", "10.0.0.1:2002", "[fd00::1]:2002", "10.0.0.2:2003"}},
+		{AddressFamilyPreferIPv6, []string{"[fd00::1]:2000", "10.0.0.2:2001", "[fd00::1]:2002", "10.0.0.2:2003"}},
+	}
+
+	for _, tt := range tests {
+		r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithAddressFamily(tt.family))
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+
+		if err = r.Update(); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		r.Close()
+
+		all := r.All()
+		if strings.Join(all, ",") != strings.Join(tt.expect, ",") {
+			t.Fatalf("unexpected addresses for family %d, %v", tt.family, all)
+		}
+	}
+}
+
+func TestUpdate_AddressFamilyIPv6(t *testing.T) {
+	s := startTestServer(t, serviceHandler(4, 2))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithAddressFamily(AddressFamilyIPv6))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	err = r.Update()
+	if err == nil || err.Error() != "unexpected not found info about host node1.node.dc1.consul." {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	s = startTestServer(t, serviceHandler(2, 1))
+
+	r, err = New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithAddressFamily(AddressFamilyIPv6))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	all := r.All()
+	if len(all) != 2 || all[0] != "[fd00::1]:2000" || all[1] != "[fd00::1]:2001" {
+		t.Fatalf("unexpected addresses %v", all)
+	}
+	if ip := r.Endpoints()[0].IP; ip.To4() != nil || !ip.Equal(net.ParseIP("fd00::1")) {
+		t.Fatalf("unexpected ip %s", ip)
+	}
+}
+
+func TestParseAddrTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		expect string
+	}{
+		{"7f000001.addr.dc1.consul.", "127.0.0.1"},
+		{"fd000000000000000000000000000001.addr.dc1.consul.", "fd00::1"},
+		{"node1.node.dc1.consul.", ""},
+		{"example.com.", ""},
+		{"7f0000.addr.dc1.consul.", ""},
+		{"zz000001.addr.dc1.consul.", ""},
+	}
+
+	for _, tt := range tests {
+		ip, ok := parseAddrTarget(tt.target)
+		if tt.expect == "" {
+			if ok {
+				t.Fatalf("unexpected ip %s for %s", ip, tt.target)
+			}
+			continue
+		}
+		if !ok || ip.String() != tt.expect {
+			t.Fatalf("unexpected ip %s for %s, expect %s", ip, tt.target, tt.expect)
+		}
+	}
+}
+
+func TestUpdate_GetAddressFromSRV(t *testing.T) {
+	var requests int64
+	handler := serviceHandler(1, 1)
+	targets := []string{"0a000001.addr.dc1.consul.", "fd000000000000000000000000000002.addr.dc1.consul.", "node0.node.dc1.consul."}
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		if q.Type != dnsmessage.TypeSRV {
+			atomic.AddInt64(&requests, 1)
+			return handler(req)
+		}
+
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: req.Header.ID}, Questions: req.Questions}
+		for i, target := range targets {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.SRVResource{Port: uint16(2000 + i), Target: dnsmessage.MustNewName(target)},
+			})
+		}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithGetAddressFromSRV())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	all := r.All()
+	if strings.Join(all, ",") != "10.0.0.1:2000,[fd00::2]:2001,10.0.0.1:2002" {
+		t.Fatalf("unexpected addresses %v", all)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("unexpected address requests count %d, expect 1", n)
+	}
+}
+
+func TestUpdate_CNAME(t *testing.T) {
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: req.Header.ID}, Questions: req.Questions}
+
+		switch q.Name.String() {
+		case "foo.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{
+				srvRecord(q.Name, 2000, "alias1.service.dc1.consul."),
+				srvRecord(q.Name, 2001, "alias2.service.dc1.consul."),
+				{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.TXTResource{TXT: []string{"consul-network-segment="}},
+				},
+			}
+		case "alias1.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{
+				cnameRecord("alias1.service.dc1.consul.", "node0.node.dc1.consul."),
+				aRecord("node0.node.dc1.consul.", [4]byte{10, 0, 0, 1}),
+			}
+		case "alias2.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{cnameRecord("alias2.service.dc1.consul.", "node1.node.dc1.consul.")}
+		case "node1.node.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{aRecord("node1.node.dc1.consul.", [4]byte{10, 0, 0, 2})}
+		}
+
+		return resp
+	})
+
+	logger := &testLogger{}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	all := r.All()
+	if strings.Join(all, ",") != "10.0.0.1:2000,10.0.0.2:2001" {
+		t.Fatalf("unexpected addresses %v", all)
+	}
+	if !logger.contains("skip unexpected record *dnsmessage.TXTResource") {
+		t.Fatalf("unexpected log %v", logger.lines)
+	}
+}
+
+func TestUpdate_CNAMELoop(t *testing.T) {
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: req.Header.ID}, Questions: req.Questions}
+
+		switch q.Name.String() {
+		case "foo.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{srvRecord(q.Name, 2000, "alias1.service.dc1.consul.")}
+		case "alias1.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{cnameRecord("alias1.service.dc1.consul.", "alias2.service.dc1.consul.")}
+		case "alias2.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{cnameRecord("alias2.service.dc1.consul.", "alias1.service.dc1.consul.")}
+		}
+
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	err = r.Update()
+	if !errors.Is(err, ErrCNAMEChainTooLong) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestUpdate_CNAMEExternalResolver(t *testing.T) {
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: req.Header.ID}, Questions: req.Questions}
+
+		switch q.Name.String() {
+		case "foo.service.dc1.consul.":
+			resp.Answers = []dnsmessage.Resource{srvRecord(q.Name, 2000, "web.example.com.")}
+		}
+
+		return resp
+	})
+
+	upstream := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: req.Header.ID, RecursionAvailable: true}, Questions: req.Questions}
+
+		if q.Type == dnsmessage.TypeA && q.Name.String() == "web.example.com." {
+			resp.Answers = []dnsmessage.Resource{
+				cnameRecord("web.example.com.", "lb.example.com."),
+				aRecord("lb.example.com.", [4]byte{192, 0, 2, 10}),
+			}
+		}
+
+		return resp
+	})
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "tcp", upstream.addr())
+		},
+	}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithExternalResolver(resolver))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	all := r.All()
+	if len(all) != 1 || all[0] != "192.0.2.10:2000" {
+		t.Fatalf("unexpected addresses %v", all)
+	}
+}
+
+func TestAutoUpdate(t *testing.T) {
+	var requests int64
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		if req.Questions[0].Type == dnsmessage.TypeSRV && atomic.AddInt64(&requests, 1) == 2 {
+			resp.Header.RCode = dnsmessage.RCodeServerFailure
+		}
+		return resp
+	})
+
+	logger := &testLogger{}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithLogger(logger), WithAutoUpdate(time.Millisecond*20, time.Millisecond*10))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&requests) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("auto update is not called")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	r.Close()
+
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+	if !logger.contains("error auto update") {
+		t.Fatalf("unexpected log %v", logger.lines)
+	}
+
+	n := atomic.LoadInt64(&requests)
+	time.Sleep(time.Millisecond * 50)
+	if atomic.LoadInt64(&requests) != n {
+		t.Fatal("auto update is not stopped")
+	}
+}
+
+func TestUpdateContext_Cancel(t *testing.T) {
+	ln, errLn := net.Listen("tcp", "127.0.0.1:0")
+	if errLn != nil {
+		t.Fatalf("error listen address, %v", errLn)
+	}
+	defer ln.Close()
+
+	r, err := New("foo", WithConsulAddress(ln.Addr().String()), WithTimeout(time.Second*10))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+
+	start := time.Now()
+
+	err = r.UpdateContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("unexpected update duration %s", d)
+	}
+}
+
+func TestUpdateContext_Deadline(t *testing.T) {
+	ln, errLn := net.Listen("tcp", "127.0.0.1:0")
+	if errLn != nil {
+		t.Fatalf("error listen address, %v", errLn)
+	}
+	defer ln.Close()
+
+	r, err := New("foo", WithConsulAddress(ln.Addr().String()), WithTimeout(time.Second*10))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	start := time.Now()
+
+	err = r.UpdateContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("unexpected update duration %s", d)
+	}
+}
+
+// doneContext is a context, which is done without the Done channel, like a context with the deadline
+// passed just after the response is read
+type doneContext struct {
+	context.Context
+}
+
+func (c doneContext) Err() error {
+	return context.DeadlineExceeded
+}
+
+func TestExchange_ResponseAfterDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		b, err := readFrame(server, defaultMaxMessageSize)
+		if err != nil {
+			return
+		}
+		res := append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+		_, _ = server.Write(res)
+	}()
+
+	r := &ConsulResolver{timeout: time.Second, maxMessageSize: defaultMaxMessageSize}
+
+	req, err := buildQuery(1, dnsmessage.Question{Name: dnsmessage.MustNewName("foo.service.dc1.consul."), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	res, err := r.exchange(doneContext{context.Background()}, client, req)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(res) != len(req)-2 {
+		t.Fatalf("unexpected response length %d, expect %d", len(res), len(req)-2)
+	}
+}
+
+func TestUpdate_Coalesce(t *testing.T) {
+	var requests int64
+	release := make(chan struct{})
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		if req.Questions[0].Type == dnsmessage.TypeSRV {
+			atomic.AddInt64(&requests, 1)
+			<-release
+			resp.Header.RCode = dnsmessage.RCodeServerFailure
+		}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second*5))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- r.Update()
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&requests) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("update is not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	started, errTry := r.TryUpdate(context.Background())
+	if started || errTry != nil {
+		t.Fatalf("unexpected try update result %v, %v", started, errTry)
+	}
+
+	// let concurrent calls join the update in progress
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		if err = <-errs; !errors.Is(err, ErrServerFailure) {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("unexpected SRV requests count %d, expect 1", n)
+	}
+
+	started, errTry = r.TryUpdate(context.Background())
+	if !started || !errors.Is(errTry, ErrServerFailure) {
+		t.Fatalf("unexpected try update result %v, %v", started, errTry)
+	}
+}
+
+func TestUpdate_CoalesceContextError(t *testing.T) {
+	var requests int64
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		if req.Questions[0].Type == dnsmessage.TypeSRV && atomic.AddInt64(&requests, 1) == 1 {
+			time.Sleep(time.Millisecond * 300)
+		}
+		return handler(req)
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second*5))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	errShort := make(chan error, 1)
+	go func() {
+		errShort <- r.UpdateContext(ctx)
+	}()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&requests) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("update is not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the caller without deadline joins the update and is not failed by the deadline of the first caller
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+	if err = <-errShort; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v, expect %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestConsulResolver_SnapshotRace(t *testing.T) {
+	var requests int64
+	handler := serviceHandler(50, 5)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		// every update returns different ports
+		if req.Questions[0].Type == dnsmessage.TypeSRV {
+			shift := uint16(atomic.AddInt64(&requests, 1) % 2 * 100)
+			for _, answer := range resp.Answers {
+				answer.Body.(*dnsmessage.SRVResource).Port += shift
+			}
+		}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second*5))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				all := r.All()
+				first := strings.Join(all, ",")
+				for _, a := range all {
+					if !strings.HasPrefix(a, "10.0.0.") {
+						t.Errorf("unexpected address %s", a)
+						return
+					}
+				}
+				if strings.Join(all, ",") != first {
+					t.Error("snapshot is changed")
+					return
+				}
+				_ = r.Next()
+				_ = r.Random()
+				_ = r.Endpoints()
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = r.Update(); err != nil {
+			t.Errorf("unexpected error, %v", err)
+			break
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestWatch(t *testing.T) {
+	var count int64 = 3
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		return serviceHandler(int(atomic.LoadInt64(&count)), 1)(req)
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := r.Watch(ctx)
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	snapshot := <-ch
+	if len(snapshot.Addresses) != 3 || len(snapshot.Endpoints) != 3 {
+		t.Fatalf("unexpected snapshot %v", snapshot.Addresses)
+	}
+
+	// the same endpoints do not produce snapshot
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	select {
+	case snapshot = <-ch:
+		t.Fatalf("unexpected snapshot %v", snapshot.Addresses)
+	default:
+	}
+
+	// the slow consumer receives only the latest snapshot
+	for _, n := range []int64{4, 5} {
+		atomic.StoreInt64(&count, n)
+		if err = r.Update(); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+	snapshot = <-ch
+	if len(snapshot.Addresses) != 5 {
+		t.Fatalf("unexpected snapshot %v", snapshot.Addresses)
+	}
+
+	// the current snapshot is sent to the new watcher
+	snapshot = <-r.Watch(ctx)
+	if len(snapshot.Addresses) != 5 {
+		t.Fatalf("unexpected snapshot %v", snapshot.Addresses)
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("unexpected channel is not closed")
+	}
+}
+
+func TestWatch_Close(t *testing.T) {
+	r, err := New("foo")
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	ch := r.Watch(context.Background())
+	r.Close()
+
+	if _, ok := <-ch; ok {
+		t.Fatal("unexpected channel is not closed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 3))
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithAutoUpdate(time.Hour, 0))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatalf("unexpected error on repeated close, %v", err)
+	}
+
+	if err = r.Update(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrClosed)
+	}
+	if ok, err := r.TryUpdate(context.Background()); ok || !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected result %v, %v, expect false, %v", ok, err, ErrClosed)
+	}
+	if err = r.WaitForEndpoints(context.Background(), 100); !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrClosed)
+	}
+}
+
+func TestClose_InterruptsUpdate(t *testing.T) {
+	// the server accepts connections, but never responds
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listen address, %v", err)
+	}
+	defer ln.Close()
+
+	r, err := New("foo", WithConsulAddress(ln.Addr().String()), WithTimeout(time.Second), WithMaxRequestAttempts(3))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	errUpdate := make(chan error, 1)
+	go func() {
+		errUpdate <- r.Update()
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	start := time.Now()
+	if err = r.Close(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Fatalf("close is blocked by the update for %s", d)
+	}
+
+	if err = <-errUpdate; !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrClosed)
+	}
+}
+
+func TestClose_WaitsForUpdate(t *testing.T) {
+	started := make(chan struct{})
+	var once sync.Once
+	handler := serviceHandler(3, 3)
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		once.Do(func() { close(started) })
+		time.Sleep(time.Millisecond * 100)
+		return handler(req)
+	})
+
+	r, err := New("service", WithConsulAddress(s.addr()))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	go func() {
+		_ = r.Update()
+	}()
+
+	<-started
+
+	if err = r.Close(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	// the update in progress is interrupted and finished before close returns
+	if !errors.Is(r.LastError(), ErrClosed) {
+		t.Fatalf("unexpected last error %v, expect %v", r.LastError(), ErrClosed)
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	var count int64 = 3
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		n := int(atomic.LoadInt64(&count))
+		resp := serviceHandler(n, 1)(req)
+		if req.Questions[0].Type == dnsmessage.TypeSRV && n == 2 {
+			// replace the first instance
+			resp.Answers[0].Body.(*dnsmessage.SRVResource).Port = 3000
+		}
+		return resp
+	})
+
+	var added, removed [][]string
+	onChange := func(a, r []Endpoint) {
+		var aa, rr []string
+		for _, e := range a {
+			aa = append(aa, e.Address)
+		}
+		for _, e := range r {
+			rr = append(rr, e.Address)
+		}
+		added = append(added, aa)
+		removed = append(removed, rr)
+	}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithOnChange(onChange))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	for _, n := range []int64{3, 3, 2} {
+		atomic.StoreInt64(&count, n)
+		if err = r.Update(); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+
+	if len(added) != 2 {
+		t.Fatalf("unexpected callback calls %d, expect 2", len(added))
+	}
+	if strings.Join(added[0], ",") != "10.0.0.1:2000,10.0.0.1:2001,10.0.0.1:2002" || len(removed[0]) != 0 {
+		t.Fatalf("unexpected first diff %v, %v", added[0], removed[0])
+	}
+	if strings.Join(added[1], ",") != "10.0.0.1:3000" || strings.Join(removed[1], ",") != "10.0.0.1:2000,10.0.0.1:2002" {
+		t.Fatalf("unexpected second diff %v, %v", added[1], removed[1])
+	}
+}
+
+func TestOnChange_UpdateFinished(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 1))
+
+	var r *ConsulResolver
+	nested := make(chan error, 1)
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithOnChange(func(_, _ []Endpoint) {
+		// the update is finished, so the next update does not wait for it
+		nested <- r.Update()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Update()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("update is blocked by the callback")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err = <-nested; err != nil {
+		t.Fatalf("unexpected nested update error, %v", err)
+	}
+}
+
+func TestUpdateGuard(t *testing.T) {
+	var count int64 = 10
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		return serviceHandler(int(atomic.LoadInt64(&count)), 1)(req)
+	})
+
+	logger := &testLogger{}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithLogger(logger), WithUpdateGuard(50, 3, 3))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		count    int64
+		rejected bool
+		expect   int
+	}{
+		{10, false, 10},
+		{6, false, 6},
+		{2, true, 6},
+		{2, true, 6},
+		{5, false, 5},
+		{2, true, 5},
+		{2, true, 5},
+		{2, false, 2},
+	}
+
+	for i, tt := range tests {
+		atomic.StoreInt64(&count, tt.count)
+		err = r.Update()
+		if tt.rejected != errors.Is(err, ErrUpdateRejected) {
+			t.Fatalf("unexpected error for step %d, %v", i, err)
+		}
+		if len(r.All()) != tt.expect {
+			t.Fatalf("unexpected services count %d for step %d, expect %d", len(r.All()), i, tt.expect)
+		}
+	}
+
+	if n := r.Stats().RejectedUpdates; n != 4 {
+		t.Fatalf("unexpected rejected updates %d, expect 4", n)
+	}
+	if !logger.contains("update rejected") {
+		t.Fatalf("unexpected log %v", logger.lines)
+	}
+}
+
+func TestUpdateGuard_MinConfirmations(t *testing.T) {
+	var count int64 = 10
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		return serviceHandler(int(atomic.LoadInt64(&count)), 1)(req)
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithUpdateGuard(50, 0, 1), WithFlapDamping(2, 0, 1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	atomic.StoreInt64(&count, 2)
+
+	if err = r.Update(); !errors.Is(err, ErrUpdateRejected) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrUpdateRejected)
+	}
+	// the rejected update does not change the damping state
+	if len(r.flaps) != 0 {
+		t.Fatalf("unexpected flap state after rejected update %v", r.flaps)
+	}
+	if len(r.All()) != 10 {
+		t.Fatalf("unexpected services count %d, expect 10", len(r.All()))
+	}
+
+	// the confirmed update is damped, removed endpoints are kept for the first absence
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 10 || len(r.flaps) != 8 {
+		t.Fatalf("unexpected services count %d and flap states %d, expect 10 and 8", len(r.All()), len(r.flaps))
+	}
+}
+
+func TestFlapDamping(t *testing.T) {
+	var count int64
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		return serviceHandler(int(atomic.LoadInt64(&count)), 1)(req)
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithFlapDamping(3, 0, 2))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		count  int64
+		expect int
+	}{
+		{3, 3},
+		{2, 3},
+		{3, 3},
+		{2, 3},
+		{2, 3},
+		{2, 2},
+		{4, 2},
+		{4, 4},
+	}
+
+	for i, tt := range tests {
+		atomic.StoreInt64(&count, tt.count)
+		if err = r.Update(); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		if len(r.All()) != tt.expect {
+			t.Fatalf("unexpected services count %d for step %d, expect %d", len(r.All()), i, tt.expect)
+		}
+	}
+}
+
+func TestFlapDamping_NoSuchService(t *testing.T) {
+	var rcode = int64(dnsmessage.RCodeSuccess)
+	s := startTestServer(t, rcodeHandler(1, &rcode))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithFlapDamping(3, 0, 1))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	// the only instance fails health check, consul responds with NXDOMAIN
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeNameError))
+
+	for i, expect := range []int{1, 1, 0} {
+		if err = r.Update(); !errors.Is(err, ErrNoSuchService) {
+			t.Fatalf("unexpected error %v, expect %v", err, ErrNoSuchService)
+		}
+		if len(r.All()) != expect {
+			t.Fatalf("unexpected services count %d for step %d, expect %d", len(r.All()), i, expect)
+		}
+	}
+}
+
+func TestFlapDamping_Delay(t *testing.T) {
+	var count int64 = 3
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		return serviceHandler(int(atomic.LoadInt64(&count)), 1)(req)
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithFlapDamping(0, time.Millisecond*50, 0))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	atomic.StoreInt64(&count, 2)
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+
+	time.Sleep(time.Millisecond * 60)
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 2 {
+		t.Fatalf("unexpected services count %d, expect 2", len(r.All()))
+	}
+}
+
+func TestMaxStale(t *testing.T) {
+	var rcode int64
+	s := startTestServer(t, rcodeHandler(3, &rcode))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithMaxStale(time.Millisecond*50))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if _, err = r.NextAddress(); !errors.Is(err, ErrNoEndpoints) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if !r.LastUpdated().IsZero() || r.LastError() != nil {
+		t.Fatal("unexpected update state")
+	}
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	updated := r.LastUpdated()
+	if updated.IsZero() || r.LastError() != nil {
+		t.Fatal("unexpected update state")
+	}
+	if a, errNext := r.NextAddress(); errNext != nil || a != "10.0.0.1:2000" {
+		t.Fatalf("unexpected next address %s, %v", a, errNext)
+	}
+
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeServerFailure))
+	if err = r.Update(); err == nil {
+		t.Fatal("unexpected no error")
+	}
+	if !r.LastUpdated().Equal(updated) || !errors.Is(r.LastError(), ErrServerFailure) {
+		t.Fatal("unexpected update state")
+	}
+	if _, err = r.RandomAddress(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+
+	if _, err = r.NextAddress(); !errors.Is(err, ErrStale) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if _, err = r.RandomAddress(); !errors.Is(err, ErrStale) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if r.Next() == "" {
+		t.Fatal("unexpected empty address")
+	}
+}
+
+func TestWaitForEndpoints(t *testing.T) {
+	waitRetryInterval = time.Millisecond * 10
+
+	var requests int64
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		if req.Questions[0].Type == dnsmessage.TypeSRV && atomic.AddInt64(&requests, 1) < 3 {
+			resp.Header.RCode = dnsmessage.RCodeServerFailure
+		}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err = r.WaitForEndpoints(ctx, 3); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Fatalf("unexpected SRV requests count %d, expect 3", n)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	err = r.WaitForEndpoints(ctx, 4)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestWaitForEndpoints_ReleasesWatcher(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 1))
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithAutoUpdate(time.Hour, 0))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.WaitForEndpoints(context.Background(), 3); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.watchMx.Lock()
+		n := len(r.watchers)
+		r.watchMx.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected watchers count %d after wait, expect 0", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNew_WaitForEndpoints(t *testing.T) {
+	var rcode int64 = int64(dnsmessage.RCodeServerFailure)
+	s := startTestServer(t, rcodeHandler(3, &rcode))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err := New("foo", WithConsulAddress(s.addr()), WithAutoUpdate(time.Millisecond*10, 0), WithWaitForEndpoints(ctx, 1))
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "RCodeServerFailure") {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeSuccess))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithAutoUpdate(time.Millisecond*10, 0), WithWaitForEndpoints(ctx, 3))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected services count %d, expect 3", len(r.All()))
+	}
+}
+
+func TestTTLInterval(t *testing.T) {
+	m := &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{TTL: 30}, Body: &dnsmessage.SRVResource{}},
+			{Header: dnsmessage.ResourceHeader{TTL: 1}, Body: &dnsmessage.TXTResource{}},
+		},
+		Additionals: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{TTL: 10}, Body: &dnsmessage.AResource{}},
+		},
+	}
+
+	tests := []struct {
+		min    time.Duration
+		max    time.Duration
+		expect time.Duration
+	}{
+		{0, 0, time.Second * 10},
+		{time.Second * 20, time.Minute, time.Second * 20},
+		{time.Second, time.Second * 5, time.Second * 5},
+	}
+
+	for _, tt := range tests {
+		r := &ConsulResolver{ttlRefresh: true, ttlRefreshMin: tt.min, ttlRefreshMax: tt.max}
+		r.storeMinTTL(m)
+		if d := r.nextAutoUpdate(); d != tt.expect {
+			t.Fatalf("unexpected interval %s, expect %s", d, tt.expect)
+		}
+	}
+
+	// consul responds with zero TTL by default, zero min interval must not schedule updates in a loop
+	zero := &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{TTL: 0}, Body: &dnsmessage.SRVResource{}},
+		},
+	}
+	r := &ConsulResolver{ttlRefresh: true}
+	r.storeMinTTL(zero)
+	if d := r.nextAutoUpdate(); d != defaultTTLRefreshMin {
+		t.Fatalf("unexpected interval %s, expect %s", d, defaultTTLRefreshMin)
+	}
+}
+
+func TestTTLRefresh(t *testing.T) {
+	var requests int64
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		if req.Questions[0].Type == dnsmessage.TypeSRV {
+			atomic.AddInt64(&requests, 1)
+			for i := range resp.Answers {
+				resp.Answers[i].Header.TTL = 0
+			}
+		}
+		return resp
+	})
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithTTLRefresh(time.Millisecond*20, time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&requests) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("auto update is not called")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Millisecond * 10, Max: time.Millisecond * 100}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 0},
+		{1, time.Millisecond * 10},
+		{2, time.Millisecond * 20},
+		{4, time.Millisecond * 80},
+		{5, time.Millisecond * 100},
+		{100, time.Millisecond * 100},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := b.Delay(tt.attempt); d < 0 || d > tt.max {
+				t.Fatalf("unexpected delay %s for attempt %d, max %s", d, tt.attempt, tt.max)
+			}
+		}
+	}
+}
+
+type testBackoff struct {
+	mx       sync.Mutex
+	attempts []int
+}
+
+func (b *testBackoff) Delay(attempt int) time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.attempts = append(b.attempts, attempt)
+	return time.Millisecond * 10
+}
+
+func TestBackoff_RequestAttempts(t *testing.T) {
+	handler := serviceHandler(3, 1)
+
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		resp.Header.ID++
+		return resp
+	})
+
+	b := &testBackoff{}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithMaxRequestAttempts(3), WithBackoff(b))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	start := time.Now()
+	if err = r.Update(); !errors.Is(err, ErrMaxAttempts) {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if d := time.Since(start); d < time.Millisecond*20 {
+		t.Fatalf("unexpected update duration %s", d)
+	}
+	if fmt.Sprint(b.attempts) != "[1 2]" {
+		t.Fatalf("unexpected backoff attempts %v", b.attempts)
+	}
+}
+
+func TestBackoff_AutoUpdate(t *testing.T) {
+	var rcode int64 = int64(dnsmessage.RCodeServerFailure)
+	s := startTestServer(t, rcodeHandler(3, &rcode))
+
+	b := &testBackoff{}
+
+	r, err := New("foo", WithConsulAddress(s.addr()), WithTimeout(time.Second), WithAutoUpdate(time.Millisecond*50, 0), WithBackoff(b))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	go func() {
+		time.Sleep(time.Millisecond * 180)
+		atomic.StoreInt64(&rcode, int64(dnsmessage.RCodeSuccess))
+	}()
+
+	if err = r.WaitForEndpoints(ctx, 3); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	// the backoff delay is shorter than the interval, failed updates are retried after the interval
+	if len(b.attempts) < 2 || len(b.attempts) > 5 || b.attempts[0] != 1 || b.attempts[1] != 2 {
+		t.Fatalf("unexpected backoff attempts %v", b.attempts)
+	}
+}
+
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) Delay(_ int) time.Duration {
+	return time.Duration(b)
+}
+
+func TestBackoff_RetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff Backoff
+		expect  time.Duration
+	}{
+		{fixedBackoff(time.Millisecond), time.Second},
+		{fixedBackoff(0), time.Second},
+		{ExponentialBackoff{}, time.Second},
+		{fixedBackoff(time.Minute), time.Minute},
+	}
+
+	for _, tt := range tests {
+		r := &ConsulResolver{autoUpdateInterval: time.Second, backoff: tt.backoff}
+		if d := r.retryDelay(1); d != tt.expect {
+			t.Fatalf("unexpected delay %s for %v, expect %s", d, tt.backoff, tt.expect)
+		}
+	}
+}
+
+func TestUpdate_PoolStats(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 3))
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithMaxOpenConns(1))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	st := r.Stats().Pool
+	if st.Dialed != 1 || st.Open != 1 || st.Idle != 1 || st.Reused == 0 {
+		t.Fatalf("unexpected pool stats %+v", st)
+	}
+}
+
+func TestUpdate_LookupConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int64
+	handler := serviceHandler(8, 8)
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		if req.Questions[0].Type == dnsmessage.TypeA {
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			for {
+				m := atomic.LoadInt64(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt64(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		return handler(req)
+	})
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithLookupConcurrency(3))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r.All()) != 8 {
+		t.Fatalf("unexpected addresses count %d, expect 8", len(r.All()))
+	}
+	if n := atomic.LoadInt64(&maxInFlight); n < 2 || n > 3 {
+		t.Fatalf("unexpected parallel lookups %d, expect 2..3", n)
+	}
+}
+
+func TestUpdate_DropUnresolvedTargets(t *testing.T) {
+	handler := serviceHandler(6, 3)
+	s := startTestServer(t, func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		if q.Type == dnsmessage.TypeA && strings.HasPrefix(q.Name.String(), "node1.") {
+			return &dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.Header.ID, RCode: dnsmessage.RCodeServerFailure},
+				Questions: req.Questions,
+			}
+		}
+		return handler(req)
+	})
+
+	r, err := New("service", WithConsulAddress(s.addr()))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); !errors.Is(err, ErrServerFailure) {
+		t.Fatalf("unexpected error %v, expect %v", err, ErrServerFailure)
+	}
+	if len(r.All()) != 0 {
+		t.Fatalf("unexpected addresses %v, expect empty", r.All())
+	}
+
+	l := &testLogger{}
+	r2, err := New("service", WithConsulAddress(s.addr()), WithDropUnresolvedTargets(), WithLogger(l))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r2.Close()
+
+	if err = r2.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(r2.All()) != 4 {
+		t.Fatalf("unexpected addresses %v, expect 4 addresses", r2.All())
+	}
+	for _, addr := range r2.All() {
+		if strings.HasPrefix(addr, "10.0.0.2:") {
+			t.Fatalf("unexpected address %s of unresolved target", addr)
+		}
+	}
+	if !l.contains("error resolve target node1.node.dc1.consul.") {
+		t.Fatalf("expect log line about unresolved target")
+	}
+}
@@ -0,0 +1,232 @@
+package go_consul_dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer is a local DNS over TCP stand-in for consul
+type testServer struct {
+	ln net.Listener
+
+	// handler builds response for request, nil response closes the connection
+	handler func(req *dnsmessage.Message) *dnsmessage.Message
+	// write sends framed response to the connection, allows to split or corrupt responses
+	write func(conn net.Conn, b []byte) error
+
+	conns int64
+	wg    sync.WaitGroup
+
+	mx     sync.Mutex
+	active map[net.Conn]struct{}
+}
+
+func startTestServer(t *testing.T, handler func(req *dnsmessage.Message) *dnsmessage.Message) *testServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listen address, %v", err)
+	}
+
+	s := &testServer{
+		ln:      ln,
+		handler: handler,
+		active:  map[net.Conn]struct{}{},
+		write: func(conn net.Conn, b []byte) error {
+			_, errWrite := conn.Write(b)
+			return errWrite
+		},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+		// client connections may be left open, close them from the server side
+		s.mx.Lock()
+		for conn := range s.active {
+			_ = conn.Close()
+		}
+		s.mx.Unlock()
+		s.wg.Wait()
+	})
+
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.conns, 1)
+		s.mx.Lock()
+		s.active[conn] = struct{}{}
+		s.mx.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *testServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mx.Lock()
+		delete(s.active, conn)
+		s.mx.Unlock()
+		_ = conn.Close()
+	}()
+
+	for {
+		b, err := readFrame(conn, defaultMaxMessageSize)
+		if err != nil {
+			return
+		}
+
+		req := &dnsmessage.Message{}
+		if err = req.Unpack(b); err != nil {
+			return
+		}
+
+		resp := s.handler(req)
+		if resp == nil {
+			return
+		}
+		resp.Header.Response = true
+
+		res, err := resp.AppendPack(make([]byte, 2, 514))
+		if err != nil {
+			return
+		}
+		l := len(res) - 2
+		res[0] = byte(l >> 8)
+		res[1] = byte(l)
+
+		if err = s.write(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+// withAdditionals adds A records of the first nodes count nodes to the additional section of SRV responses
+func withAdditionals(handler func(req *dnsmessage.Message) *dnsmessage.Message, nodes int) func(req *dnsmessage.Message) *dnsmessage.Message {
+	return func(req *dnsmessage.Message) *dnsmessage.Message {
+		resp := handler(req)
+		if req.Questions[0].Type != dnsmessage.TypeSRV {
+			return resp
+		}
+		for i := 0; i < nodes; i++ {
+			resp.Additionals = append(resp.Additionals, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(fmt.Sprintf("node%d.node.dc1.consul.", i)), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i + 1)}},
+			})
+		}
+		return resp
+	}
+}
+
+// serviceHandler responds with count SRV records for service foo, instances are spread over nodes count nodes
+func serviceHandler(count, nodes int) func(req *dnsmessage.Message) *dnsmessage.Message {
+	return func(req *dnsmessage.Message) *dnsmessage.Message {
+		q := req.Questions[0]
+		resp := &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: req.Header.ID},
+			Questions: req.Questions,
+		}
+
+		switch q.Type {
+		case dnsmessage.TypeSRV:
+			for i := 0; i < count; i++ {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 30},
+					Body: &dnsmessage.SRVResource{
+						Priority: 1,
+						Weight:   uint16(i%10 + 1),
+						Port:     uint16(2000 + i),
+						Target:   dnsmessage.MustNewName(fmt.Sprintf("node%d.node.dc1.consul.", i%nodes)),
+					},
+				})
+			}
+		case dnsmessage.TypeA:
+			var node int
+			_, _ = fmt.Sscanf(q.Name.String(), "node%d.", &node)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(node + 1)}},
+			})
+		case dnsmessage.TypeAAAA:
+			// only even nodes have IPv6 address
+			var node int
+			_, _ = fmt.Sscanf(q.Name.String(), "node%d.", &node)
+			if node%2 == 0 {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0: 0xfd, 15: byte(node + 1)}},
+				})
+			}
+		}
+
+		return resp
+	}
+}
+
+// testLogger collects log lines
+type testLogger struct {
+	mx    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, a ...any) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, a...))
+}
+
+func (l *testLogger) contains(s string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func srvRecord(name dnsmessage.Name, port uint16, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.SRVResource{Port: port, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+func cnameRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func aRecord(name string, a [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
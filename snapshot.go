@@ -0,0 +1,122 @@
+package go_consul_dns
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Snapshot is a set of resolved endpoints. It is published atomically and never changed after publishing,
+// so slices returned by All and Endpoints are safe to use after the next Update. Slices must not be modified
+type Snapshot struct {
+	// Addresses are endpoint addresses, the same values as returned by All
+	Addresses []string
+	Endpoints []Endpoint
+}
+
+var emptySnapshot = &Snapshot{}
+
+func newSnapshot(endpoints []Endpoint) *Snapshot {
+	addresses := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		addresses = append(addresses, e.Address)
+	}
+
+	return &Snapshot{
+		Addresses: addresses,
+		Endpoints: endpoints,
+	}
+}
+
+// equal returns true, if snapshots contain the same endpoints regardless of order and TTL
+func (s *Snapshot) equal(other *Snapshot) bool {
+	if len(s.Endpoints) != len(other.Endpoints) {
+		return false
+	}
+
+	a := endpointKeys(s.Endpoints)
+	b := endpointKeys(other.Endpoints)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// endpointKeys returns sorted keys of the endpoints
+func endpointKeys(endpoints []Endpoint) []string {
+	keys := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		keys = append(keys, e.Address+" "+e.Target+" "+strconv.Itoa(int(e.Priority))+" "+strconv.Itoa(int(e.Weight)))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// load returns the current snapshot
+func (r *ConsulResolver) load() *Snapshot {
+	s := r.snapshot.Load()
+	if s == nil {
+		return emptySnapshot
+	}
+	return s
+}
+
+// store publishes new snapshot with the endpoints and notifies watchers, if the endpoints are changed
+func (r *ConsulResolver) store(endpoints []Endpoint) {
+	s := newSnapshot(endpoints)
+
+	prev := r.snapshot.Swap(s)
+	if prev == nil {
+		prev = emptySnapshot
+	}
+
+	if !s.equal(prev) {
+		r.notify(s)
+	}
+
+	if r.onChange != nil {
+		added, removed := diffEndpoints(prev.Endpoints, s.Endpoints)
+		if len(added) > 0 || len(removed) > 0 {
+			r.changes = append(r.changes, endpointsChange{added: added, removed: removed})
+		}
+	}
+}
+
+// endpointsChange is the change for OnChange callback, which is called after the update is finished
+type endpointsChange struct {
+	added   []Endpoint
+	removed []Endpoint
+}
+
+// diffEndpoints returns endpoints of next with addresses missing in prev
+// and endpoints of prev with addresses missing in next
+func diffEndpoints(prev, next []Endpoint) ([]Endpoint, []Endpoint) {
+	var added, removed []Endpoint
+
+	counts := map[string]int{}
+	for _, e := range prev {
+		counts[e.Address]++
+	}
+	for _, e := range next {
+		if counts[e.Address] > 0 {
+			counts[e.Address]--
+			continue
+		}
+		added = append(added, e)
+	}
+
+	counts = map[string]int{}
+	for _, e := range next {
+		counts[e.Address]++
+	}
+	for _, e := range prev {
+		if counts[e.Address] > 0 {
+			counts[e.Address]--
+			continue
+		}
+		removed = append(removed, e)
+	}
+
+	return added, removed
+}
@@ -0,0 +1,99 @@
+package go_consul_dns
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// updateResult is the result of the last finished update
+type updateResult struct {
+	updatedAt time.Time
+	err       error
+}
+
+// recordResult stores the update result, the time of the last successful update is kept on errors
+func (r *ConsulResolver) recordResult(err error) {
+	res := &updateResult{err: err}
+
+	if prev := r.result.Load(); prev != nil {
+		res.updatedAt = prev.updatedAt
+	}
+	if err == nil {
+		res.updatedAt = time.Now()
+	}
+
+	r.result.Store(res)
+}
+
+// LastUpdated returns the time of the last successful update or zero time, if there were no successful updates
+func (r *ConsulResolver) LastUpdated() time.Time {
+	res := r.result.Load()
+	if res == nil {
+		return time.Time{}
+	}
+	return res.updatedAt
+}
+
+// LastError returns the error of the last update or nil, if the last update was successful
+func (r *ConsulResolver) LastError() error {
+	res := r.result.Load()
+	if res == nil {
+		return nil
+	}
+	return res.err
+}
+
+// checkStale returns ErrStale, if the data is older than max stale duration
+func (r *ConsulResolver) checkStale() error {
+	if r.maxStale <= 0 {
+		return nil
+	}
+
+	res := r.result.Load()
+	if res == nil || res.updatedAt.IsZero() {
+		return nil
+	}
+
+	age := time.Since(res.updatedAt)
+	if age <= r.maxStale {
+		return nil
+	}
+
+	if res.err != nil {
+		return fmt.Errorf("%w, age %s, last error: %v", ErrStale, age.Round(time.Millisecond), res.err)
+	}
+	return fmt.Errorf("%w, age %s", ErrStale, age.Round(time.Millisecond))
+}
+
+// NextAddress returns next address with simple round-robin like Next.
+// It returns ErrNoEndpoints for empty cache and ErrStale, if the data is older than max stale duration
+func (r *ConsulResolver) NextAddress() (string, error) {
+	if err := r.checkStale(); err != nil {
+		return "", err
+	}
+
+	data := r.load().Addresses
+	if len(data) == 0 {
+		return "", ErrNoEndpoints
+	}
+
+	n := atomic.AddInt64(&r.counter, 1)
+	return data[int(n-1)%len(data)], nil
+}
+
+// RandomAddress returns random address like Random.
+// It returns ErrNoEndpoints for empty cache and ErrStale, if the data is older than max stale duration
+func (r *ConsulResolver) RandomAddress() (string, error) {
+	if err := r.checkStale(); err != nil {
+		return "", err
+	}
+
+	data := r.load().Addresses
+	if len(data) == 0 {
+		return "", ErrNoEndpoints
+	}
+
+	return data[rand.Intn(len(data))], nil
+}
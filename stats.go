@@ -0,0 +1,25 @@
+package go_consul_dns
+
+import "sync/atomic"
+
+// Stats contains resolver counters for diagnostics
+type Stats struct {
+	// LookupFallbacks is a count of explicit address requests for SRV targets, which are missing in the additional section
+	LookupFallbacks int64
+	// RejectedUpdates is a count of updates rejected by the update guard
+	RejectedUpdates int64
+	// TruncatedFallbacks is a count of queries repeated over TCP, because the UDP response is truncated
+	TruncatedFallbacks int64
+	// Pool contains connection pool counters
+	Pool PoolStats
+}
+
+// Stats returns resolver counters
+func (r *ConsulResolver) Stats() Stats {
+	return Stats{
+		LookupFallbacks:    atomic.LoadInt64(&r.lookupFallbacks),
+		RejectedUpdates:    atomic.LoadInt64(&r.rejectedUpdates),
+		TruncatedFallbacks: atomic.LoadInt64(&r.truncatedFallbacks),
+		Pool:               r.pool.stats(),
+	}
+}
@@ -0,0 +1,119 @@
+package go_consul_dns
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minUDPSize is the DNS message size over UDP without EDNS0 (RFC 1035)
+const minUDPSize = 512
+
+// transportAttempt sends the query over UDP, if it is enabled, and repeats it over TCP,
+// if the UDP response is truncated. It returns true, if the failed query may be retried
+func (r *ConsulResolver) transportAttempt(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, bool, error) {
+	if r.udpSize > 0 {
+		m, retry, err := r.udpAttempt(ctx, q)
+		if err != nil || !m.Header.Truncated {
+			return m, retry, err
+		}
+		atomic.AddInt64(&r.truncatedFallbacks, 1)
+	}
+
+	if r.mux != nil {
+		return r.muxAttempt(ctx, q)
+	}
+	return r.attempt(ctx, q)
+}
+
+// udpAttempt sends the query in a single datagram with EDNS0 buffer size and waits for the matching response.
+// Datagrams, which do not match the query, are skipped. It returns true, if the failed query may be retried
+func (r *ConsulResolver) udpAttempt(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, bool, error) {
+	id := uint16(rand.Intn(1 << 16))
+
+	req, errBuild := buildUDPQuery(id, q, r.udpSize)
+	if errBuild != nil {
+		return nil, false, errBuild
+	}
+
+	d := net.Dialer{Timeout: r.timeout}
+	conn, errDial := d.DialContext(ctx, "udp", r.address)
+	if errDial != nil {
+		return nil, false, fmt.Errorf("error dial udp, %w", wrapTimeout(errDial))
+	}
+	defer func() {
+		if errClose := conn.Close(); errClose != nil {
+			r.logger.Printf("error close udp connection, %v", errClose)
+		}
+	}()
+
+	defer interruptOnDone(ctx, conn)()
+
+	if errDeadline := conn.SetDeadline(r.deadline(ctx)); errDeadline != nil {
+		return nil, false, fmt.Errorf("error set deadline, %w", errDeadline)
+	}
+
+	if _, errWrite := conn.Write(req); errWrite != nil {
+		r.logger.Printf("error write udp query, %v", errWrite)
+		return nil, true, fmt.Errorf("error write to udp connection, %w", wrapTimeout(errWrite))
+	}
+
+	buf := make([]byte, r.udpSize)
+
+	for {
+		n, errRead := conn.Read(buf)
+		if errRead != nil {
+			if errCtx := contextError(ctx); errCtx != nil {
+				return nil, false, errCtx
+			}
+			r.logger.Printf("error read udp response, %v", errRead)
+			return nil, true, fmt.Errorf("error read from udp connection, %w", wrapTimeout(errRead))
+		}
+
+		m := &dnsmessage.Message{}
+		if errUnpack := m.Unpack(buf[:n]); errUnpack != nil {
+			r.logger.Printf("skip udp response, %v", errUnpack)
+			continue
+		}
+
+		if errCheck := checkResponse(m, id, q); errCheck != nil {
+			r.logger.Printf("skip udp response, %v", errCheck)
+			continue
+		}
+
+		return m, false, nil
+	}
+}
+
+// buildUDPQuery returns DNS query message with single question and EDNS0 OPT record with UDP buffer size
+func buildUDPQuery(id uint16, q dnsmessage.Question, size int) ([]byte, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id})
+	if err := b.StartQuestions(); err != nil {
+		return nil, fmt.Errorf("error build message, start questions, %w", err)
+	}
+	if err := b.Question(q); err != nil {
+		return nil, fmt.Errorf("error build message, add question, %w", err)
+	}
+
+	if err := b.StartAdditionals(); err != nil {
+		return nil, fmt.Errorf("error build message, start additionals, %w", err)
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(size, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, fmt.Errorf("error build message, set edns0, %w", err)
+	}
+	if err := b.OPTResource(h, dnsmessage.OPTResource{}); err != nil {
+		return nil, fmt.Errorf("error build message, add opt record, %w", err)
+	}
+
+	req, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("error build message, finish, %w", err)
+	}
+
+	return req, nil
+}
@@ -0,0 +1,171 @@
+package go_consul_dns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udpServer is a local DNS over UDP stand-in for consul, it truncates responses larger than the EDNS0 buffer size
+type udpServer struct {
+	conn    net.PacketConn
+	handler func(req *dnsmessage.Message) *dnsmessage.Message
+
+	queries   int64
+	truncated int64
+	// size is the last EDNS0 buffer size from the request
+	size int64
+
+	wg sync.WaitGroup
+}
+
+// startUDPServer listens UDP on the same address as the TCP test server
+func startUDPServer(t *testing.T, addr string, handler func(req *dnsmessage.Message) *dnsmessage.Message) *udpServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("error listen address, %v", err)
+	}
+
+	s := &udpServer{conn: conn, handler: handler}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		s.wg.Wait()
+	})
+
+	return s
+}
+
+func (s *udpServer) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.queries, 1)
+
+		req := &dnsmessage.Message{}
+		if err = req.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		size := minUDPSize
+		for _, a := range req.Additionals {
+			if a.Header.Type == dnsmessage.TypeOPT {
+				size = int(a.Header.Class)
+			}
+		}
+		atomic.StoreInt64(&s.size, int64(size))
+
+		resp := s.handler(req)
+		resp.Header.Response = true
+
+		res, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+
+		if len(res) > size {
+			atomic.AddInt64(&s.truncated, 1)
+			resp = &dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.Header.ID, Response: true, Truncated: true},
+				Questions: req.Questions,
+			}
+			if res, err = resp.Pack(); err != nil {
+				continue
+			}
+		}
+
+		_, _ = s.conn.WriteTo(res, addr)
+	}
+}
+
+func TestUDP_SmallService(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 3))
+	u := startUDPServer(t, s.addr(), serviceHandler(3, 3))
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithUDP(1232))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if len(r.All()) != 3 {
+		t.Fatalf("unexpected addresses count %d, expect 3", len(r.All()))
+	}
+	// SRV query and 3 A queries
+	if n := atomic.LoadInt64(&u.queries); n != 4 {
+		t.Fatalf("unexpected udp queries count %d, expect 4", n)
+	}
+	if n := atomic.LoadInt64(&u.size); n != 1232 {
+		t.Fatalf("unexpected edns0 buffer size %d, expect 1232", n)
+	}
+	if n := atomic.LoadInt64(&s.conns); n != 0 {
+		t.Fatalf("unexpected tcp connections count %d, expect 0", n)
+	}
+	if n := r.Stats().TruncatedFallbacks; n != 0 {
+		t.Fatalf("unexpected truncated fallbacks %d, expect 0", n)
+	}
+}
+
+func TestUDP_TruncatedFallback(t *testing.T) {
+	s := startTestServer(t, serviceHandler(300, 3))
+	u := startUDPServer(t, s.addr(), serviceHandler(300, 3))
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithUDP(1232))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if len(r.All()) != 300 {
+		t.Fatalf("unexpected addresses count %d, expect 300", len(r.All()))
+	}
+	if n := atomic.LoadInt64(&u.truncated); n != 1 {
+		t.Fatalf("unexpected truncated responses count %d, expect 1", n)
+	}
+	if n := r.Stats().TruncatedFallbacks; n != 1 {
+		t.Fatalf("unexpected truncated fallbacks %d, expect 1", n)
+	}
+	if n := atomic.LoadInt64(&s.conns); n != 1 {
+		t.Fatalf("unexpected tcp connections count %d, expect 1", n)
+	}
+}
+
+func TestUDP_MinBufferSize(t *testing.T) {
+	s := startTestServer(t, serviceHandler(3, 3))
+	u := startUDPServer(t, s.addr(), serviceHandler(3, 3))
+
+	r, err := New("service", WithConsulAddress(s.addr()), WithUDP(100))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer r.Close()
+
+	if err = r.Update(); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := atomic.LoadInt64(&u.size); n != minUDPSize {
+		t.Fatalf("unexpected edns0 buffer size %d, expect %d", n, minUDPSize)
+	}
+}
@@ -0,0 +1,68 @@
+package go_consul_dns
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// waitRetryInterval is a delay between updates in WaitForEndpoints without auto update
+var waitRetryInterval = time.Millisecond * 500
+
+// WaitForEndpoints blocks until at least count endpoints are resolved or the context is done.
+// With auto update it waits for background updates, otherwise it calls UpdateContext until success
+func (r *ConsulResolver) WaitForEndpoints(ctx context.Context, count int) error {
+	if len(r.All()) >= count {
+		return nil
+	}
+
+	if r.autoUpdateEnabled() {
+		// the watcher is unregistered on return, not when the caller context is done
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := r.Watch(watchCtx)
+		for s := range ch {
+			if len(s.Addresses) >= count {
+				return nil
+			}
+		}
+		return r.waitError(ctx, count)
+	}
+
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return r.waitError(ctx, count)
+		case <-r.ctx.Done():
+			return r.waitError(ctx, count)
+		case <-t.C:
+		}
+
+		errUpdate := r.UpdateContext(ctx)
+		if errUpdate != nil {
+			r.logger.Printf("error update, %v", errUpdate)
+		}
+		if len(r.All()) >= count {
+			return nil
+		}
+
+		t.Reset(waitRetryInterval)
+	}
+}
+
+func (r *ConsulResolver) waitError(ctx context.Context, count int) error {
+	// the context is not done, so the resolver is closed
+	err := ctx.Err()
+	if err == nil {
+		err = ErrClosed
+	}
+
+	if lastErr := r.LastError(); lastErr != nil {
+		return fmt.Errorf("error wait for endpoints, resolved %d of %d, %w, last error: %v", len(r.All()), count, err, lastErr)
+	}
+	return fmt.Errorf("error wait for endpoints, resolved %d of %d, %w", len(r.All()), count, err)
+}
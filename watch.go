@@ -0,0 +1,59 @@
+package go_consul_dns
+
+import "context"
+
+// Watch returns a channel, which receives new snapshot every time the endpoints are changed by Update.
+// If the endpoints have been resolved already, the current snapshot is sent first.
+//
+// The channel keeps only the latest snapshot: if the consumer is slow, not received snapshot is replaced
+// with the newer one, so Update is never blocked. The channel is closed when the context is done
+// or the resolver is closed
+func (r *ConsulResolver) Watch(ctx context.Context) <-chan Snapshot {
+	ch := make(chan Snapshot, 1)
+
+	r.watchMx.Lock()
+	if r.watchers == nil {
+		r.watchers = map[chan Snapshot]struct{}{}
+	}
+	r.watchers[ch] = struct{}{}
+	if s := r.snapshot.Load(); s != nil {
+		ch <- *s
+	}
+	r.watchMx.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-r.ctx.Done():
+		}
+
+		r.watchMx.Lock()
+		delete(r.watchers, ch)
+		close(ch)
+		r.watchMx.Unlock()
+	}()
+
+	return ch
+}
+
+// notify sends the snapshot to all watchers with latest-wins policy
+func (r *ConsulResolver) notify(s *Snapshot) {
+	r.watchMx.Lock()
+	defer r.watchMx.Unlock()
+
+	for ch := range r.watchers {
+		for {
+			select {
+			case ch <- *s:
+			default:
+				// drop not received snapshot and retry
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}